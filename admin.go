@@ -0,0 +1,294 @@
+package ocache
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// adminPrefix is the path, below the pool's base path, of the admin
+// endpoints. It shadows any relation named "_admin".
+const adminPrefix = "_admin/"
+
+type relationResponse struct {
+	Relation string     `json:"relation"`
+	Capacity int64      `json:"capacity"`
+	Stats    CacheStats `json:"stats"`
+	// Purged is the number of entries a purge dropped from memory.
+	Purged int64 `json:"purged,omitempty"`
+}
+
+type statusResponse struct {
+	Host   string `json:"host"`
+	Status string `json:"status"`
+}
+
+type ringResponse struct {
+	Host  string     `json:"host"`
+	Nodes []ringNode `json:"nodes"`
+}
+
+type ringNode struct {
+	Peer         string `json:"peer"`
+	VirtualNodes int    `json:"virtualNodes"`
+	// Ownership is the fraction of the keys the peer owns.
+	Ownership float64 `json:"ownership"`
+}
+
+type ownerResponse struct {
+	Key   string `json:"key"`
+	Owner string `json:"owner"`
+	Self  bool   `json:"self"`
+}
+
+// serveAdmin handles requests for /<base path>/_admin/<path>.
+//
+//	PUT    capacity/<relation>?bytes=<n>   resize the relation's cache
+//	GET    relations                       every relation with its stats
+//	GET    relations/<relation>            the relation with its stats
+//	DELETE relations/<relation>            purge the relation's cache
+//	PUT    relations/<relation>/keys/<key> cache the request body as key's value
+//	DELETE relations/<relation>/keys/<key> drop key from the relation's cache
+//	GET    snapshot/<relation>             the relation's cache as SaveSnapshot writes it
+//	GET    ring                            the peers and their share of keys
+//	GET    owner/<key>                     the peer owning key
+//	GET    rebalance                       RebalanceStats of the pool
+//	GET    status                          whether the pool is serving or draining
+//
+// Puts, purges and drops only affect this node's cache. Changes need an
+// identity given to WithAdmins, reads of a relation one its WithReaders
+// allows.
+func (p *HTTPPool) serveAdmin(w http.ResponseWriter, request *http.Request, identity, path string) {
+	switch {
+	case strings.HasPrefix(path, "capacity/"):
+		relationName, err := url.PathUnescape(path[len("capacity/"):])
+		if err != nil {
+			http.Error(w, "Bad relation: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.serveCapacity(w, request, identity, relationName)
+	case strings.HasPrefix(path, "relations/"):
+		p.serveRelation(w, request, identity, path[len("relations/"):])
+	case request.Method != http.MethodGet && request.Method != http.MethodHead:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case path == "relations":
+		list := []relationResponse{}
+		for _, r := range registeredRelations() {
+			if r.canRead(identity) {
+				list = append(list, describe(r))
+			}
+		}
+		writeJSON(w, list)
+	case path == "ring":
+		writeJSON(w, p.ring())
+	case strings.HasPrefix(path, "snapshot/"):
+		relationName, err := url.PathUnescape(path[len("snapshot/"):])
+		if err != nil {
+			http.Error(w, "Bad relation: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		r := GetRelation(relationName)
+		if r == nil {
+			http.Error(w, "No such relation: "+relationName, http.StatusNotFound)
+			return
+		}
+		if !p.authorize(w, r, identity) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if request.Method == http.MethodHead {
+			return
+		}
+		if err := r.SaveSnapshot(w); err != nil {
+			p.Log("Failed to snapshot relation %s: %v", relationName, err)
+		}
+	case strings.HasPrefix(path, "owner/"):
+		key, err := url.PathUnescape(path[len("owner/"):])
+		if err != nil || key == "" {
+			http.Error(w, "Bad key", http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		owner := ""
+		if p.peers != nil {
+			owner = p.peers.Get(key)
+		}
+		p.mu.Unlock()
+		if owner == "" {
+			owner = p.host
+		}
+		writeJSON(w, ownerResponse{Key: key, Owner: owner, Self: owner == p.host})
+	case path == "rebalance":
+		writeJSON(w, p.RebalanceStats())
+	case path == "status":
+		status := statusResponse{Host: p.host, Status: "serving"}
+		if p.Draining() {
+			status.Status = statusDraining
+		}
+		writeJSON(w, status)
+	default:
+		http.Error(w, "No such admin endpoint: "+path, http.StatusNotFound)
+	}
+}
+
+// serveRelation handles relations/<relation> and
+// relations/<relation>/keys/<key>, path being escaped.
+func (p *HTTPPool) serveRelation(w http.ResponseWriter, request *http.Request, identity, path string) {
+	escRelation, escKey, isKey := strings.Cut(path, "/keys/")
+	relationName, err := url.PathUnescape(escRelation)
+	if err != nil || relationName == "" {
+		http.Error(w, "Bad relation", http.StatusBadRequest)
+		return
+	}
+	key, err := url.PathUnescape(escKey)
+	if err != nil || (isKey && key == "") {
+		http.Error(w, "Bad key", http.StatusBadRequest)
+		return
+	}
+	r := GetRelation(relationName)
+	if r == nil {
+		http.Error(w, "No such relation: "+relationName, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case request.Method == http.MethodGet || request.Method == http.MethodHead:
+		if !p.authorize(w, r, identity) {
+			return
+		}
+	case request.Method == http.MethodDelete || (request.Method == http.MethodPut && isKey):
+		if !p.authorizeAdmin(w, identity) {
+			return
+		}
+	}
+
+	var purged int64
+	switch {
+	case request.Method == http.MethodPut && isKey:
+		value, err := io.ReadAll(request.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.Set(key, value); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrValueTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		p.Log("Set key %s of relation %s", key, relationName)
+	case request.Method == http.MethodDelete && isKey:
+		r.Remove(key)
+		p.Log("Dropped key %s of relation %s", key, relationName)
+	case request.Method == http.MethodDelete:
+		purged = r.Purge()
+		p.Log("Purged %d entries of relation %s", purged, relationName)
+	case isKey:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	case request.Method != http.MethodGet && request.Method != http.MethodHead:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := describe(r)
+	res.Purged = purged
+	writeJSON(w, res)
+}
+
+// ring describes the pool's current peers.
+func (p *HTTPPool) ring() ringResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := ringResponse{Host: p.host, Nodes: []ringNode{}}
+	if p.peers == nil {
+		return res
+	}
+	vnodes, shares := p.peers.VirtualNodes(), p.peers.Ownership()
+	for _, peer := range p.ringMembersLocked() {
+		res.Nodes = append(res.Nodes, ringNode{
+			Peer:         peer,
+			VirtualNodes: vnodes[peer],
+			Ownership:    shares[peer],
+		})
+	}
+	return res
+}
+
+func describe(r *Relation) relationResponse {
+	return relationResponse{
+		Relation: r.name,
+		Capacity: r.Capacity(),
+		Stats:    r.CacheStats(),
+	}
+}
+
+// registeredRelations lists every relation, sorted by name.
+func registeredRelations() []*Relation {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]*Relation, 0, len(relations))
+	for _, r := range relations {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+func (p *HTTPPool) serveCapacity(w http.ResponseWriter, request *http.Request, identity, relationName string) {
+	r := GetRelation(relationName)
+	if r == nil {
+		http.Error(w, "No such relation: "+relationName, http.StatusNotFound)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		if !p.authorize(w, r, identity) {
+			return
+		}
+	case http.MethodPut:
+		if !p.authorizeAdmin(w, identity) {
+			return
+		}
+		// 0 would lift the limit, which is for NewRelation to decide.
+		bytes, err := strconv.ParseInt(request.URL.Query().Get("bytes"), 10, 64)
+		if err != nil || bytes <= 0 {
+			http.Error(w, "Bad bytes: want a positive number", http.StatusBadRequest)
+			return
+		}
+		if err := r.SetCapacity(bytes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.Log("Relation %s resized to %d bytes", relationName, bytes)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, describe(r))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
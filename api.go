@@ -0,0 +1,317 @@
+package ocache
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"google.golang.org/protobuf/proto"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media types served by APIHandler.
+const (
+	rawContentType   = "application/octet-stream"
+	jsonContentType  = "application/json"
+	protoContentType = "application/x-protobuf"
+)
+
+// APIHandler is the HTTP API for clients of the cache, as opposed to the
+// peer protocol served by HTTPPool:
+//
+//	GET    /relations/<relation>/keys/<key>  the value
+//	PUT    /relations/<relation>/keys/<key>  Relation.Set the request body
+//	DELETE /relations/<relation>/keys/<key>  Relation.Remove
+//
+// Values are served as raw bytes, JSON with the value base64 encoded or a
+// protobuf pb.Response as the Accept header asks, and PUT bodies are read
+// in the format of their Content-Type. Responses carry an ETag honored in
+// If-None-Match, and a Cache-Control max-age until the value goes stale.
+// Mount it below a prefix with http.StripPrefix.
+//
+// With Auth, requests that fail its verification are refused with 401
+// Unauthorized. GETs are subject to the relation's WithReaders, and PUTs
+// and DELETEs are only allowed to Writers; others are refused with 403
+// Forbidden, including every caller of a handler without Auth.
+type APIHandler struct {
+	Auth Authenticator
+	// Writers are the identities, as returned by Auth, that may PUT and
+	// DELETE.
+	Writers []string
+}
+
+// apiValue is the JSON representation of a value.
+type apiValue struct {
+	Relation string `json:"relation"`
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	// Expires is the hard deadline of the value, if any.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h APIHandler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	var identity string
+	if h.Auth != nil {
+		var err error
+		if identity, err = h.Auth.Verify(request); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	name, key, ok := parseAPIPath(request.URL.EscapedPath())
+	if !ok {
+		http.NotFound(w, request)
+		return
+	}
+	if len(key) > MaxKeyLength {
+		http.Error(w, "Key too long", http.StatusBadRequest)
+		return
+	}
+	r := GetRelation(name)
+	if r == nil {
+		http.Error(w, "No such relation: "+name, http.StatusNotFound)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		if !r.canRead(identity) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		serveAPIGet(w, request, r, key)
+	case http.MethodPut:
+		if !h.canWrite(identity) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		value, err := readAPIBody(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.Set(key, value); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrValueTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !h.canWrite(identity) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		r.Remove(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// canWrite reports whether identity is one of the Writers.
+func (h APIHandler) canWrite(identity string) bool {
+	for _, w := range h.Writers {
+		if identity != "" && w == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAPIPath splits an escaped /relations/<relation>/keys/<key> path.
+func parseAPIPath(path string) (relation, key string, ok bool) {
+	rest := strings.TrimPrefix(path, "/relations/")
+	if rest == path {
+		return "", "", false
+	}
+	escRelation, escKey, ok := strings.Cut(rest, "/keys/")
+	if !ok {
+		return "", "", false
+	}
+	relation, err := url.PathUnescape(escRelation)
+	if err != nil {
+		return "", "", false
+	}
+	if key, err = url.PathUnescape(escKey); err != nil {
+		return "", "", false
+	}
+	return relation, key, relation != "" && key != ""
+}
+
+func serveAPIGet(w http.ResponseWriter, request *http.Request, r *Relation, key string) {
+	contentType, ok := negotiate(request.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "Not acceptable, use one of "+
+			strings.Join([]string{rawContentType, jsonContentType, protoContentType}, ", "),
+			http.StatusNotAcceptable)
+		return
+	}
+
+	view, err := r.Get(key)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrValueTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var body []byte
+	switch contentType {
+	case jsonContentType:
+		v := apiValue{Relation: r.name, Key: key, Value: view.rawBytes()}
+		if !view.expire.IsZero() {
+			v.Expires = &view.expire
+		}
+		body, err = json.Marshal(v)
+	case protoContentType:
+		body, err = proto.Marshal(&pb.Response{Value: view.rawBytes()})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Vary", "Accept")
+	h.Set("ETag", etag(view, contentType))
+	if maxAge, ok := maxAge(view, time.Now()); ok {
+		h.Set("Cache-Control", "max-age="+strconv.Itoa(maxAge))
+	}
+	if matchETag(request.Header.Get("If-None-Match"), h.Get("ETag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if body == nil {
+		h.Set("Content-Length", strconv.Itoa(view.Len()))
+		if request.Method != http.MethodHead {
+			_, _ = view.WriteTo(w)
+		}
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if request.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// negotiate picks the media type to serve for an Accept header, raw
+// bytes unless the client prefers one of the others.
+func negotiate(accept string) (string, bool) {
+	if accept == "" {
+		return rawContentType, true
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "*/*", "application/*":
+			mediaType = rawContentType
+		case "application/protobuf":
+			mediaType = protoContentType
+		case rawContentType, jsonContentType, protoContentType:
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best, best != ""
+}
+
+// readAPIBody reads the value in a PUT body.
+func readAPIBody(request *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	mediaType := rawContentType
+	if ct := request.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil, err
+		}
+	}
+	switch mediaType {
+	case jsonContentType:
+		var v apiValue
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, err
+		}
+		return v.Value, nil
+	case protoContentType, "application/protobuf":
+		var res pb.Response
+		if err := proto.Unmarshal(body, &res); err != nil {
+			return nil, err
+		}
+		return res.Value, nil
+	default:
+		return body, nil
+	}
+}
+
+// etag is a strong validator of the representation of view.
+func etag(view ByteView, contentType string) string {
+	h := fnv.New64a()
+	_, _ = view.WriteTo(h)
+	_, _ = io.WriteString(h, contentType)
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// matchETag reports whether an If-None-Match header matches tag.
+func matchETag(ifNoneMatch, tag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAge returns the seconds until view goes stale, or expires if it
+// never goes stale, and false if it has no deadline.
+func maxAge(view ByteView, now time.Time) (int, bool) {
+	deadline := view.stale
+	if deadline.IsZero() {
+		deadline = view.expire
+	}
+	if deadline.IsZero() {
+		return 0, false
+	}
+	seconds := int(deadline.Sub(now) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	return seconds, true
+}
+
+var _ http.Handler = APIHandler{}
@@ -0,0 +1,144 @@
+package ocache
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_APIHandler(t *testing.T) {
+	NewRelation("API", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			if key == "missing" {
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+			}
+			return []byte("value of " + key), nil
+		},
+	), WithExpiry(time.Minute, time.Hour))
+	srv := httptest.NewServer(http.StripPrefix("/api", APIHandler{
+		Auth:    HMACAuth{Keys: testKeys},
+		Writers: []string{"writer"},
+	}))
+	defer srv.Close()
+	keyURL := srv.URL + "/api/relations/API/keys/"
+
+	do := func(method, url string, header map[string]string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		if err := (HMACAuth{Secret: testKeys["writer"], ID: "writer"}).Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(b)
+	}
+
+	res, body := do(http.MethodGet, keyURL+"a/b", nil, "")
+	if res.StatusCode != http.StatusOK || body != "value of a/b" {
+		t.Fatalf("GET raw = %s %q", res.Status, body)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "max-age=59" && cc != "max-age=60" {
+		t.Fatalf("Cache-Control = %q, want the soft expiry", cc)
+	}
+	tag := res.Header.Get("ETag")
+	if res, _ := do(http.MethodGet, keyURL+"a/b", map[string]string{"If-None-Match": tag}, ""); res.StatusCode != http.StatusNotModified {
+		t.Fatalf("GET If-None-Match = %s", res.Status)
+	}
+
+	res, body = do(http.MethodGet, keyURL+"k", map[string]string{"Accept": "text/html, application/json;q=0.9"}, "")
+	var v apiValue
+	if err := json.Unmarshal([]byte(body), &v); err != nil || string(v.Value) != "value of k" || v.Expires == nil {
+		t.Fatalf("GET json = %q, %v", body, err)
+	}
+	if res.Header.Get("ETag") == "" || res.Header.Get("ETag") == tag {
+		t.Fatalf("representations share ETag %q", tag)
+	}
+	_, body = do(http.MethodGet, keyURL+"k", map[string]string{"Accept": "application/x-protobuf"}, "")
+	out := &pb.Response{}
+	if err := proto.Unmarshal([]byte(body), out); err != nil || string(out.Value) != "value of k" {
+		t.Fatalf("GET protobuf = %q, %v", body, err)
+	}
+
+	if res, _ := do(http.MethodPut, keyURL+"k", map[string]string{"Content-Type": "application/json"}, `{"value":"bmV3"}`); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT = %s", res.Status)
+	}
+	if _, body := do(http.MethodGet, keyURL+"k", nil, ""); body != "new" {
+		t.Fatalf("GET after PUT = %q", body)
+	}
+	if res, _ := do(http.MethodDelete, keyURL+"k", nil, ""); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE = %s", res.Status)
+	}
+	if _, body := do(http.MethodGet, keyURL+"k", nil, ""); body != "value of k" {
+		t.Fatalf("GET after DELETE = %q", body)
+	}
+
+	for url, want := range map[string]int{
+		keyURL + "missing":                      http.StatusNotFound,
+		srv.URL + "/api/relations/Nope/keys/k":  http.StatusNotFound,
+		srv.URL + "/api/relations/API":          http.StatusNotFound,
+		srv.URL + "/api/relations/API/keys/":    http.StatusNotFound,
+		srv.URL + "/api/elsewhere/API/keys/key": http.StatusNotFound,
+	} {
+		if res, _ := do(http.MethodGet, url, nil, ""); res.StatusCode != want {
+			t.Fatalf("GET %s = %s, want %d", url, res.Status, want)
+		}
+	}
+	if res, _ := do(http.MethodGet, keyURL+"k", map[string]string{"Accept": "text/html"}, ""); res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("GET text/html = %s", res.Status)
+	}
+	if res, _ := do(http.MethodPost, keyURL+"k", nil, ""); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST = %s", res.Status)
+	}
+}
+
+func Test_APIHandlerAuth(t *testing.T) {
+	NewRelation("API/private", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		},
+	), WithReaders("reader"))
+	h := APIHandler{Auth: HMACAuth{Keys: testKeys}, Writers: []string{"writer"}}
+	keyPath := "/relations/API%2Fprivate/keys/k"
+	for _, tt := range []struct {
+		handler APIHandler
+		method  string
+		id      string
+		want    int
+	}{
+		{h, http.MethodGet, "reader", http.StatusOK},
+		{h, http.MethodGet, "writer", http.StatusForbidden},
+		{h, http.MethodGet, "", http.StatusUnauthorized},
+		{h, http.MethodPut, "writer", http.StatusNoContent},
+		{h, http.MethodPut, "reader", http.StatusForbidden},
+		{h, http.MethodDelete, "reader", http.StatusForbidden},
+		{h, http.MethodDelete, "writer", http.StatusNoContent},
+		{APIHandler{}, http.MethodGet, "", http.StatusForbidden},
+		{APIHandler{}, http.MethodPut, "", http.StatusForbidden},
+		{APIHandler{}, http.MethodDelete, "", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, signedRequest(t, tt.method, keyPath, tt.id, strings.NewReader("v")))
+		if w.Code != tt.want {
+			t.Fatalf("%s as %q with auth %v = %d, want %d", tt.method, tt.id, tt.handler.Auth != nil, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package arena
+
+import "encoding/binary"
+
+// headerSize is the size of the header stored before each entry:
+// key length (4 bytes), value length (4 bytes) and key hash (8 bytes).
+const headerSize = 16
+
+// MinCap is the smallest capacity New and Resize accept.
+const MinCap = headerSize + 1
+
+// Cache is a FIFO cache that packs entries into a single preallocated
+// ring buffer and locates them through an index of hashed keys. Neither
+// the buffer nor the index contains pointers, so the garbage collector
+// never scans the entries no matter how many of them are stored.
+// It is not safe for concurrent access.
+type Cache struct {
+	buf   []byte
+	head  uint64            // logical offset of the oldest entry
+	tail  uint64            // logical offset of the next write
+	index map[uint64]uint64 // key hash -> logical offset
+	live  int64             // bytes of the entries in index
+	// optional and executed when a live entry is purged.
+	OnEvicted func(key string, value []byte)
+}
+
+// New is the Constructor of Cache. The whole cap is allocated up front.
+func New(cap int64, onEvicted func(string, []byte)) *Cache {
+	if cap < MinCap {
+		panic("arena: cap too small")
+	}
+	return &Cache{
+		buf:       make([]byte, cap),
+		index:     make(map[uint64]uint64),
+		OnEvicted: onEvicted,
+	}
+}
+
+// Get look ups a key's value. The returned slice is a copy and stays
+// valid after the entry is overwritten.
+func (c *Cache) Get(key string) (value []byte, ok bool) {
+	off, ok := c.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	keyLen, valLen, _ := c.header(off)
+	value = make([]byte, valLen)
+	c.read(off+headerSize+uint64(keyLen), value)
+	return value, true
+}
+
+// Add adds a value to the cache, evicting the oldest entries to make room.
+// It reports false if the entry can never fit in the buffer.
+func (c *Cache) Add(key string, value []byte) bool {
+	size := uint64(headerSize + len(key) + len(value))
+	if size > uint64(len(c.buf)) {
+		c.Remove(key)
+		return false
+	}
+	for uint64(len(c.buf))-(c.tail-c.head) < size {
+		c.Eviction()
+	}
+
+	h := hash(key)
+	if prev, ok := c.index[h]; ok {
+		c.live -= int64(c.sizeAt(prev))
+	}
+	var hdr [headerSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(value)))
+	binary.LittleEndian.PutUint64(hdr[8:], h)
+	c.write(c.tail, hdr[:])
+	c.write(c.tail+headerSize, []byte(key))
+	c.write(c.tail+headerSize+uint64(len(key)), value)
+
+	// an older entry for the same hash becomes dead space that is
+	// reclaimed once the head passes it.
+	c.index[h] = c.tail
+	c.tail += size
+	c.live += int64(size)
+	return true
+}
+
+// Remove drops key from the index. Its bytes are reclaimed lazily.
+func (c *Cache) Remove(key string) {
+	if off, ok := c.lookup(key); ok {
+		delete(c.index, hash(key))
+		c.live -= int64(c.sizeAt(off))
+	}
+}
+
+// Eviction removes the oldest entry, live or dead.
+func (c *Cache) Eviction() {
+	if c.head == c.tail {
+		return
+	}
+	off := c.head
+	keyLen, valLen, h := c.header(off)
+	size := headerSize + uint64(keyLen) + uint64(valLen)
+	c.head += size
+	if cur, ok := c.index[h]; !ok || cur != off {
+		return
+	}
+	delete(c.index, h)
+	c.live -= int64(size)
+	if c.OnEvicted != nil {
+		key := make([]byte, keyLen)
+		value := make([]byte, valLen)
+		c.read(off+headerSize, key)
+		c.read(off+headerSize+uint64(keyLen), value)
+		c.OnEvicted(string(key), value)
+	}
+}
+
+// Resize moves the live entries into a new buffer of cap bytes, dropping
+// dead space. When they don't all fit, the oldest are evicted.
+func (c *Cache) Resize(cap int64) {
+	if cap < MinCap {
+		panic("arena: cap too small")
+	}
+	for c.live > cap {
+		c.Eviction()
+	}
+	old := *c
+	c.buf = make([]byte, cap)
+	c.head, c.tail = 0, 0
+	c.index = make(map[uint64]uint64, len(old.index))
+	for off := old.head; off < old.tail; {
+		keyLen, valLen, h := old.header(off)
+		size := headerSize + uint64(keyLen) + uint64(valLen)
+		if cur, ok := old.index[h]; ok && cur == off {
+			entry := make([]byte, size)
+			old.read(off, entry)
+			c.write(c.tail, entry)
+			c.index[h] = c.tail
+			c.tail += size
+		}
+		off += size
+	}
+}
+
+// Range calls f for every live entry from the oldest to the newest, until
+// f returns false. The key and value passed to f are copies.
+func (c *Cache) Range(f func(key string, value []byte) bool) {
+	for off := c.head; off < c.tail; {
+		keyLen, valLen, h := c.header(off)
+		size := headerSize + uint64(keyLen) + uint64(valLen)
+		if cur, ok := c.index[h]; ok && cur == off {
+			key := make([]byte, keyLen)
+			value := make([]byte, valLen)
+			c.read(off+headerSize, key)
+			c.read(off+headerSize+uint64(keyLen), value)
+			if !f(string(key), value) {
+				return
+			}
+		}
+		off += size
+	}
+}
+
+// Len the number of live entries.
+func (c *Cache) Len() int {
+	return len(c.index)
+}
+
+// Size the number of buffer bytes in use, including headers and dead entries.
+func (c *Cache) Size() int64 {
+	return int64(c.tail - c.head)
+}
+
+// Live the number of buffer bytes used by live entries.
+func (c *Cache) Live() int64 {
+	return c.live
+}
+
+// Cap the size of the buffer.
+func (c *Cache) Cap() int64 {
+	return int64(len(c.buf))
+}
+
+func (c *Cache) lookup(key string) (uint64, bool) {
+	off, ok := c.index[hash(key)]
+	if !ok {
+		return 0, false
+	}
+	keyLen, _, _ := c.header(off)
+	if int(keyLen) != len(key) {
+		return 0, false
+	}
+	stored := make([]byte, keyLen)
+	c.read(off+headerSize, stored)
+	if string(stored) != key {
+		return 0, false
+	}
+	return off, true
+}
+
+func (c *Cache) sizeAt(off uint64) uint64 {
+	keyLen, valLen, _ := c.header(off)
+	return headerSize + uint64(keyLen) + uint64(valLen)
+}
+
+func (c *Cache) header(off uint64) (keyLen, valLen uint32, h uint64) {
+	var hdr [headerSize]byte
+	c.read(off, hdr[:])
+	return binary.LittleEndian.Uint32(hdr[0:]),
+		binary.LittleEndian.Uint32(hdr[4:]),
+		binary.LittleEndian.Uint64(hdr[8:])
+}
+
+// read copies len(p) bytes starting at logical offset off, wrapping
+// around the end of the buffer.
+func (c *Cache) read(off uint64, p []byte) {
+	i := int(off % uint64(len(c.buf)))
+	n := copy(p, c.buf[i:])
+	copy(p[n:], c.buf)
+}
+
+// write is the counterpart of read.
+func (c *Cache) write(off uint64, p []byte) {
+	i := int(off % uint64(len(c.buf)))
+	n := copy(c.buf[i:], p)
+	copy(c.buf, p[n:])
+}
+
+// hash is 64-bit FNV-1a, inlined to avoid allocating a hash.Hash per call.
+func hash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,108 @@
+package arena
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Get(t *testing.T) {
+	a := New(int64(1<<10), nil)
+	a.Add("key1", []byte("1234"))
+	if v, ok := a.Get("key1"); !ok || string(v) != "1234" {
+		t.Fatalf("arena hit key1=1234 failed")
+	}
+	if _, ok := a.Get("key2"); ok {
+		t.Fatalf("arena miss key2 failed")
+	}
+}
+
+func Test_Eviction(t *testing.T) {
+	k1, k2, k3 := "key1", "key2", "k3"
+	v1, v2, v3 := "value1", "value2", "v3"
+	capitation := 2*headerSize + len(k1+k2+v1+v2)
+	a := New(int64(capitation), nil)
+	a.Add(k1, []byte(v1))
+	a.Add(k2, []byte(v2))
+	a.Add(k3, []byte(v3))
+
+	if _, ok := a.Get("key1"); ok || a.Len() != 2 {
+		t.Fatalf("Removeoldest key1 failed")
+	}
+	if v, ok := a.Get(k3); !ok || string(v) != v3 {
+		t.Fatalf("wrapped entry k3 corrupted")
+	}
+}
+
+func Test_OnEvicted(t *testing.T) {
+	keys := make([]string, 0)
+	callback := func(key string, value []byte) {
+		keys = append(keys, key)
+	}
+	a := New(int64(3*headerSize+10), callback)
+	a.Add("key1", []byte("123456"))
+	a.Add("k2", []byte("k2"))
+	a.Add("k3", []byte("k3"))
+	a.Add("k4", []byte("k4"))
+
+	expect := []string{"key1", "k2"}
+
+	if !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("Call OnEvicted failed, expect keys equals to %s, got %s", expect, keys)
+	}
+}
+
+func Test_Update(t *testing.T) {
+	a := New(int64(1<<10), nil)
+	a.Add("key", []byte("old"))
+	a.Add("key", []byte("new"))
+	if v, ok := a.Get("key"); !ok || string(v) != "new" || a.Len() != 1 {
+		t.Fatalf("update key failed")
+	}
+	if a.Add("big", make([]byte, 1<<10)) {
+		t.Fatalf("oversized entry should be rejected")
+	}
+	a.Remove("key")
+	if _, ok := a.Get("key"); ok || a.Len() != 0 {
+		t.Fatalf("remove key failed")
+	}
+}
+
+func Test_Resize(t *testing.T) {
+	a := New(int64(1<<10), nil)
+	a.Add("k1", []byte("v1"))
+	a.Add("k2", []byte("v2"))
+	a.Add("k1", []byte("v1"))
+	a.Add("k3", []byte("v3"))
+	a.Resize(2 * (headerSize + 4))
+	if _, ok := a.Get("k2"); ok || a.Len() != 2 || a.Cap() != 2*(headerSize+4) {
+		t.Fatalf("shrink failed, len=%d", a.Len())
+	}
+	for _, k := range []string{"k1", "k3"} {
+		if v, ok := a.Get(k); !ok || string(v) != "v"+k[1:] {
+			t.Fatalf("%s lost in resize", k)
+		}
+	}
+	a.Resize(1 << 10)
+	a.Add("k4", []byte("v4"))
+	if a.Len() != 3 {
+		t.Fatalf("grow failed, len=%d", a.Len())
+	}
+}
+
+func Test_Range(t *testing.T) {
+	a := New(int64(1<<10), nil)
+	a.Add("k1", []byte("v1"))
+	a.Add("k2", []byte("v2"))
+	a.Add("k1", []byte("v1'"))
+	a.Add("k3", []byte("v3"))
+	a.Remove("k3")
+
+	got := make([]string, 0)
+	a.Range(func(key string, value []byte) bool {
+		got = append(got, key+"="+string(value))
+		return true
+	})
+	if !reflect.DeepEqual(got, []string{"k2=v2", "k1=v1'"}) {
+		t.Fatalf("Range visited %s, want live entries oldest first", got)
+	}
+}
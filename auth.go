@@ -0,0 +1,326 @@
+package ocache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// An Authenticator authenticates the requests peers send each other.
+// Sign is called on every request an HTTPPool sends, Verify on every
+// request it serves and returns the identity of the caller.
+type Authenticator interface {
+	Sign(req *http.Request) error
+	Verify(req *http.Request) (identity string, err error)
+}
+
+// WithAuth authenticates the requests the pool sends and serves with a.
+// Requests that fail verification are refused with 401 Unauthorized.
+// Every peer should use the same kind of Authenticator.
+func WithAuth(a Authenticator) PoolOption {
+	return func(p *HTTPPool) {
+		p.auth = a
+	}
+}
+
+// WithReaders only lets the given identities, as returned by the pool's
+// Authenticator or WithPeerVerification, read the relation through an
+// HTTPPool. Everyone else is
+// refused with 403 Forbidden, including every caller of a pool without an
+// Authenticator. Local Gets are not affected.
+func WithReaders(identities ...string) RelationOption {
+	return func(r *Relation) {
+		r.readers = make(map[string]bool, len(identities))
+		for _, id := range identities {
+			r.readers[id] = true
+		}
+	}
+}
+
+// WithAdmins lets the given identities, as returned by the pool's
+// Authenticator or WithPeerVerification, change relations through the
+// admin endpoints. Everyone else is refused with 403 Forbidden, including
+// every caller of a pool without an Authenticator.
+func WithAdmins(identities ...string) PoolOption {
+	return func(p *HTTPPool) {
+		p.admins = make(map[string]bool, len(identities))
+		for _, id := range identities {
+			p.admins[id] = true
+		}
+	}
+}
+
+// canRead reports whether identity may read the relation over HTTP.
+func (r *Relation) canRead(identity string) bool {
+	return r.readers == nil || (identity != "" && r.readers[identity])
+}
+
+const (
+	peerHeader      = "X-Ocache-Peer"
+	timestampHeader = "X-Ocache-Timestamp"
+	nonceHeader     = "X-Ocache-Nonce"
+	bodyHashHeader  = "X-Ocache-Content-SHA256"
+	signatureHeader = "X-Ocache-Signature"
+)
+
+// DefaultReplayWindow is how old a request HMACAuth accepts by default.
+const DefaultReplayWindow = 30 * time.Second
+
+// HMACAuth is an Authenticator signing the method, URL, timestamp,
+// identity, a random nonce and the SHA-256 of the body of a request with
+// HMAC-SHA256. Requests with a timestamp more than Window away from the
+// local clock, DefaultReplayWindow if Window is 0, are refused, and so are
+// requests with a nonce seen within the window. The body is checked as the
+// handler reads it: reading a body that doesn't match its hash fails at
+// the end.
+//
+// Requests are signed with Secret as ID. With Keys, Verify checks them
+// with the key of the ID they claim, which proves it. Without Keys, it
+// checks them with Secret; as anyone holding a shared secret could claim
+// any ID, such requests have no identity, and WithReaders, WithAdmins and
+// APIHandler.Writers refuse them.
+type HMACAuth struct {
+	Secret []byte
+	// ID identifies this peer in the requests it signs.
+	ID string
+	// Keys are the keys of the identities Verify accepts, by ID.
+	Keys   map[string][]byte
+	Window time.Duration
+}
+
+var (
+	errBadSignature = errors.New("bad signature")
+	errBadBody      = errors.New("body doesn't match its signed hash")
+	errReplayed     = errors.New("replayed request")
+)
+
+// Sign implements Authenticator.
+func (a HMACAuth) Sign(req *http.Request) error {
+	hash, err := bodyHash(req)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	req.Header.Set(peerHeader, a.ID)
+	req.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(nonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(bodyHashHeader, hash)
+	req.Header.Set(signatureHeader, hex.EncodeToString(a.mac(req, a.Secret)))
+	return nil
+}
+
+// Verify implements Authenticator.
+func (a HMACAuth) Verify(req *http.Request) (string, error) {
+	id, ts, nonce := req.Header.Get(peerHeader), req.Header.Get(timestampHeader), req.Header.Get(nonceHeader)
+	key, identity := a.Secret, ""
+	if a.Keys != nil {
+		var ok bool
+		if key, ok = a.Keys[id]; !ok {
+			return "", errBadSignature
+		}
+		identity = id
+	}
+	sig, err := hex.DecodeString(req.Header.Get(signatureHeader))
+	if err != nil || nonce == "" || len(key) == 0 || !hmac.Equal(sig, a.mac(req, key)) {
+		return "", errBadSignature
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", errBadSignature
+	}
+	window := a.Window
+	if window == 0 {
+		window = DefaultReplayWindow
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > window || age < -window {
+		return "", fmt.Errorf("timestamp %s outside the %v replay window", ts, window)
+	}
+	// the request can't be replayed once its timestamp is outside the
+	// window, so the nonce needs to be remembered until then.
+	if !seenNonces.add(id+"\x00"+nonce, time.Unix(sec, 0).Add(window)) {
+		return "", errReplayed
+	}
+	if req.Body != nil {
+		req.Body = &hashReader{ReadCloser: req.Body, hash: sha256.New(), want: req.Header.Get(bodyHashHeader)}
+	}
+	return identity, nil
+}
+
+func (a HMACAuth) mac(req *http.Request, key []byte) []byte {
+	path, query := req.URL.EscapedPath(), req.URL.RawQuery
+	if req.RequestURI != "" {
+		// a request being served, possibly below an http.StripPrefix that
+		// changed its URL: use the one that was sent.
+		if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+			path, query = u.EscapedPath(), u.RawQuery
+		}
+	}
+	m := hmac.New(sha256.New, key)
+	for _, s := range []string{
+		req.Method, path, query,
+		req.Header.Get(timestampHeader), req.Header.Get(peerHeader),
+		req.Header.Get(nonceHeader), req.Header.Get(bodyHashHeader),
+	} {
+		m.Write([]byte(s))
+		m.Write([]byte{0})
+	}
+	return m.Sum(nil)
+}
+
+// bodyHash returns the hex SHA-256 of the body of req. A body that can't
+// be read again through GetBody is buffered, so that it can still be sent.
+func bodyHash(req *http.Request) (string, error) {
+	h := sha256.New()
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, body)
+		_ = body.Close()
+		if err != nil {
+			return "", err
+		}
+	default:
+		b, err := io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashReader fails the read that reaches the end of a body that doesn't
+// hash to want.
+type hashReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.want {
+		return n, errBadBody
+	}
+	return n, err
+}
+
+// seenNonces remembers the nonces of the requests HMACAuth verified.
+var seenNonces = &nonceSet{m: make(map[string]time.Time)}
+
+type nonceSet struct {
+	mu    sync.Mutex
+	m     map[string]time.Time // to when it may be forgotten
+	swept time.Time
+}
+
+// add records nonce until expire, and reports whether it is new.
+func (s *nonceSet) add(nonce string, expire time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.swept) > time.Second {
+		for n, e := range s.m {
+			if now.After(e) {
+				delete(s.m, n)
+			}
+		}
+		s.swept = now
+	}
+	if _, ok := s.m[nonce]; ok {
+		return false
+	}
+	s.m[nonce] = expire
+	return true
+}
+
+var _ Authenticator = HMACAuth{}
+
+// do sends req to a peer with client, or http.DefaultClient if nil,
+// signed by auth if there is one.
+func do(client *http.Client, auth Authenticator, req *http.Request) (*http.Response, error) {
+	if auth != nil {
+		if err := auth.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// authenticate returns the identity of the caller of request, writing an
+// error response if it can't be verified.
+func (p *HTTPPool) authenticate(w http.ResponseWriter, request *http.Request) (identity string, ok bool) {
+	if p.verifyPeers {
+		if identity, ok = p.peerIdentity(request); !ok {
+			p.Log("Refused %s %s from a non-peer", request.Method, request.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return "", false
+		}
+	}
+	if p.auth == nil {
+		return identity, true
+	}
+	claimed, err := p.auth.Verify(request)
+	if err != nil {
+		p.Log("Unauthenticated %s %s: %v", request.Method, request.URL.Path, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if p.verifyPeers && claimed != "" && claimed != identity {
+		// the certificate is the stronger proof, don't let the request
+		// speak for another peer.
+		p.Log("Refused %s %s signed as %q by peer %s", request.Method, request.URL.Path, claimed, identity)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	if p.verifyPeers {
+		return identity, true
+	}
+	return claimed, true
+}
+
+// authorizeAdmin writes an error response unless identity is one of the
+// pool's admins.
+func (p *HTTPPool) authorizeAdmin(w http.ResponseWriter, identity string) bool {
+	if identity != "" && p.admins[identity] {
+		return true
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// authorize writes an error response unless identity may read r.
+func (p *HTTPPool) authorize(w http.ResponseWriter, r *Relation, identity string) bool {
+	if r.canRead(identity) {
+		return true
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
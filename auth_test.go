@@ -0,0 +1,146 @@
+package ocache
+
+import (
+	"encoding/hex"
+	"errors"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_HMACAuth(t *testing.T) {
+	a := HMACAuth{Secret: testKeys["peer-a"], ID: "peer-a", Keys: testKeys}
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://server/_ocache/r/k?x=1", nil)
+		if err := a.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	if id, err := a.Verify(newRequest()); err != nil || id != "peer-a" {
+		t.Fatalf("Verify = %q, %v; want peer-a", id, err)
+	}
+
+	ts := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	tampered := newRequest()
+	tampered.URL.Path = "/_ocache/r/other"
+	impostor := newRequest()
+	impostor.Header.Set(peerHeader, "peer-b")
+	// peer-b signing as peer-a with its own key.
+	forged, _ := http.NewRequest(http.MethodGet, "http://server/_ocache/r/k", nil)
+	if err := (HMACAuth{Secret: testKeys["peer-b"], ID: "peer-a"}).Sign(forged); err != nil {
+		t.Fatal(err)
+	}
+	unknown, _ := http.NewRequest(http.MethodGet, "http://server/_ocache/r/k", nil)
+	if err := (HMACAuth{Secret: testKeys["peer-a"], ID: "peer-c"}).Sign(unknown); err != nil {
+		t.Fatal(err)
+	}
+	retimed := newRequest()
+	retimed.Header.Set(timestampHeader, ts)
+	for name, req := range map[string]*http.Request{
+		"tampered": tampered,
+		"impostor": impostor,
+		"forged":   forged,
+		"unknown":  unknown,
+		"retimed":  retimed,
+	} {
+		if _, err := a.Verify(req); err == nil {
+			t.Fatalf("%s request verified", name)
+		}
+	}
+
+	old := newRequest()
+	old.Header.Set(timestampHeader, ts)
+	old.Header.Set(signatureHeader, hex.EncodeToString(a.mac(old, a.Secret)))
+	if _, err := a.Verify(old); err == nil {
+		t.Fatalf("request older than the replay window verified")
+	}
+	if _, err := (HMACAuth{Keys: testKeys, Window: 2 * time.Minute}).Verify(old); err != nil {
+		t.Fatalf("request within a longer window refused: %v", err)
+	}
+
+	// a shared secret doesn't prove the ID claimed.
+	if id, err := (HMACAuth{Secret: testKeys["peer-a"]}).Verify(newRequest()); err != nil || id != "" {
+		t.Fatalf("Verify with a shared secret = %q, %v; want no identity", id, err)
+	}
+
+	replayed := newRequest()
+	if _, err := a.Verify(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Verify(replayed); !errors.Is(err, errReplayed) {
+		t.Fatalf("replayed request: Verify = %v; want errReplayed", err)
+	}
+}
+
+func Test_HMACAuthBody(t *testing.T) {
+	a := HMACAuth{Secret: testKeys["peer-a"], ID: "peer-a", Keys: testKeys}
+	for _, tt := range []struct {
+		body string
+		want error
+	}{
+		{"signed", nil},
+		{"swapped", errBadBody},
+	} {
+		req, _ := http.NewRequest(http.MethodPut, "http://server/_ocache/_lease/r/k", strings.NewReader("signed"))
+		if err := a.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		req.Body = io.NopCloser(strings.NewReader(tt.body))
+		if _, err := a.Verify(req); err != nil {
+			t.Fatal(err)
+		}
+		if body, err := io.ReadAll(req.Body); err != tt.want {
+			t.Fatalf("reading body %q = %q, %v; want %v", tt.body, body, err, tt.want)
+		}
+	}
+
+	// bodies that can't be read again are buffered.
+	req := httptest.NewRequest(http.MethodPut, "/_ocache/_admin/relations/r/keys/k", strings.NewReader("value"))
+	if err := a.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Verify(req); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(req.Body); err != nil || string(body) != "value" {
+		t.Fatalf("reading buffered body = %q, %v", body, err)
+	}
+}
+
+func Test_Readers(t *testing.T) {
+	NewRelation("ACL", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		},
+	), WithReaders("peer-a"))
+	srv := httptest.NewServer(NewHTTPPool("http://server", WithAuth(HMACAuth{Keys: testKeys})))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		auth Authenticator
+		want string
+	}{
+		{HMACAuth{Secret: testKeys["peer-a"], ID: "peer-a"}, ""},
+		{HMACAuth{Secret: testKeys["peer-b"], ID: "peer-b"}, "403"},
+		{HMACAuth{Secret: testKeys["peer-b"], ID: "peer-a"}, "401"},
+		{HMACAuth{Secret: []byte("guess"), ID: "peer-a"}, "401"},
+		{nil, "401"},
+	} {
+		peer := &httpGetter{baseURL: srv.URL + defaultBasePath, auth: tt.auth}
+		res := &pb.Response{}
+		err := peer.Get(&pb.Request{Relation: "ACL", Key: "key"}, res)
+		switch {
+		case tt.want == "" && (err != nil || string(res.Value) != "key"):
+			t.Fatalf("%+v: Get = %q, %v", tt.auth, res.Value, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Fatalf("%+v: Get = %v; want %s", tt.auth, err, tt.want)
+		}
+	}
+}
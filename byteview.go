@@ -1,25 +1,178 @@
 package ocache
 
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
 // A ByteView holds an immutable view of bytes.
+// Internally it wraps either a []byte or a string,
+// but that detail is invisible to callers.
 type ByteView struct {
+	// If bytes is non-nil, bytes is used, else str is used.
 	bytes []byte
+	str   string
+	// after stale the view is still served but refreshed in the
+	// background, after expire it is not served at all. Zero means never.
+	stale, expire time.Time
+	// name of the Compressor the data is compressed with, empty if none.
+	// Encoded views never leave the package.
+	encoding string
 }
 
 // Len returns the view's length
 func (view ByteView) Len() int {
-	return len(view.bytes)
+	if view.bytes != nil {
+		return len(view.bytes)
+	}
+	return len(view.str)
+}
+
+// Expire returns the time after which the view is no longer served from
+// the cache, or the zero time if it never expires.
+func (view ByteView) Expire() time.Time {
+	return view.expire
+}
+
+func (view ByteView) expired(now time.Time) bool {
+	return !view.expire.IsZero() && now.After(view.expire)
 }
 
 // ByteSlice returns a copy of the data as a byte slice.
 func (view ByteView) ByteSlice() []byte {
-	return cloneBytes(view.bytes)
+	if view.bytes != nil {
+		return cloneBytes(view.bytes)
+	}
+	return []byte(view.str)
 }
 
 // String returns the data as a string, making a copy if necessary.
 func (view ByteView) String() string {
-	return string(view.bytes)
+	if view.bytes != nil {
+		return string(view.bytes)
+	}
+	return view.str
+}
+
+// rawBytes returns the data as a byte slice without copying it when the
+// view is backed by one. The result must not be modified.
+func (view ByteView) rawBytes() []byte {
+	if view.bytes != nil {
+		return view.bytes
+	}
+	return []byte(view.str)
+}
+
+// At returns the byte at index i.
+func (view ByteView) At(i int) byte {
+	if view.bytes != nil {
+		return view.bytes[i]
+	}
+	return view.str[i]
+}
+
+// Slice slices the view between the provided from and to indices
+// without copying.
+func (view ByteView) Slice(from, to int) ByteView {
+	if view.bytes != nil {
+		view.bytes = view.bytes[from:to]
+	} else {
+		view.str = view.str[from:to]
+	}
+	return view
+}
+
+// SliceFrom slices the view from the provided index until the end
+// without copying.
+func (view ByteView) SliceFrom(from int) ByteView {
+	if view.bytes != nil {
+		view.bytes = view.bytes[from:]
+	} else {
+		view.str = view.str[from:]
+	}
+	return view
+}
+
+// Copy copies the view into dest and returns the number of bytes copied.
+func (view ByteView) Copy(dest []byte) int {
+	if view.bytes != nil {
+		return copy(dest, view.bytes)
+	}
+	return copy(dest, view.str)
+}
+
+// Equal returns whether the bytes in view are the same as the bytes in b2.
+func (view ByteView) Equal(b2 ByteView) bool {
+	if b2.bytes == nil {
+		return view.EqualString(b2.str)
+	}
+	return view.EqualBytes(b2.bytes)
+}
+
+// EqualString returns whether the bytes in view are the same as the bytes
+// in s.
+func (view ByteView) EqualString(s string) bool {
+	if view.bytes == nil {
+		return view.str == s
+	}
+	// comparing against string(...) doesn't allocate.
+	return string(view.bytes) == s
+}
+
+// EqualBytes returns whether the bytes in view are the same as the bytes b2.
+func (view ByteView) EqualBytes(b2 []byte) bool {
+	if view.bytes != nil {
+		return bytes.Equal(view.bytes, b2)
+	}
+	return view.str == string(b2)
 }
 
+// Reader returns an io.ReadSeeker for the bytes in view.
+func (view ByteView) Reader() io.ReadSeeker {
+	if view.bytes != nil {
+		return bytes.NewReader(view.bytes)
+	}
+	return strings.NewReader(view.str)
+}
+
+// ReadAt implements io.ReaderAt on the bytes in view.
+func (view ByteView) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("view: invalid offset")
+	}
+	if off >= int64(view.Len()) {
+		return 0, io.EOF
+	}
+	n = view.SliceFrom(int(off)).Copy(p)
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// WriteTo implements io.WriterTo on the bytes in view.
+func (view ByteView) WriteTo(w io.Writer) (n int64, err error) {
+	var m int
+	if view.bytes != nil {
+		m, err = w.Write(view.bytes)
+	} else {
+		m, err = io.WriteString(w, view.str)
+	}
+	if err == nil && m < view.Len() {
+		err = io.ErrShortWrite
+	}
+	n = int64(m)
+	return
+}
+
+var (
+	_ io.ReaderAt = ByteView{}
+	_ io.WriterTo = ByteView{}
+)
+
 func cloneBytes(bytes []byte) []byte {
 	newBytes := make([]byte, len(bytes))
 	copy(newBytes, bytes)
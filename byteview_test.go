@@ -0,0 +1,81 @@
+package ocache
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func Test_ByteView(t *testing.T) {
+	for _, s := range []string{"", "x", "yy"} {
+		for _, view := range []ByteView{{bytes: []byte(s)}, {str: s}} {
+			if view.Len() != len(s) || view.String() != s || string(view.ByteSlice()) != s {
+				t.Fatalf("view of %q: Len/String/ByteSlice failed", s)
+			}
+			if !view.EqualString(s) || !view.EqualBytes([]byte(s)) || view.EqualString(s+"z") {
+				t.Fatalf("view of %q: EqualString/EqualBytes failed", s)
+			}
+			if !view.Equal(ByteView{str: s}) || !view.Equal(ByteView{bytes: []byte(s)}) {
+				t.Fatalf("view of %q: Equal failed", s)
+			}
+
+			all, err := io.ReadAll(view.Reader())
+			if err != nil || string(all) != s {
+				t.Fatalf("view of %q: Reader = %q, %v", s, all, err)
+			}
+			var buf bytes.Buffer
+			if n, err := view.WriteTo(&buf); err != nil || n != int64(len(s)) || buf.String() != s {
+				t.Fatalf("view of %q: WriteTo = %d, %v", s, n, err)
+			}
+			dest, want := make([]byte, 1), len(s)
+			if want > 1 {
+				want = 1
+			}
+			if n := view.Copy(dest); n != want || string(dest[:n]) != s[:n] {
+				t.Fatalf("view of %q: Copy = %d", s, n)
+			}
+		}
+	}
+}
+
+func Test_ByteViewSlice(t *testing.T) {
+	const s = "x123456789"
+	for _, view := range []ByteView{{bytes: []byte(s)}, {str: s}} {
+		if view.At(1) != '1' || view.Slice(2, 4).String() != "23" || view.SliceFrom(8).String() != "89" {
+			t.Fatalf("At/Slice/SliceFrom failed")
+		}
+
+		p := make([]byte, 4)
+		if n, err := view.ReadAt(p, 3); n != 4 || err != nil || string(p) != "3456" {
+			t.Fatalf("ReadAt(3) = %d, %v, %q", n, err, p)
+		}
+		if n, err := view.ReadAt(p, 8); n != 2 || err != io.EOF || string(p[:n]) != "89" {
+			t.Fatalf("ReadAt(8) = %d, %v", n, err)
+		}
+		if _, err := view.ReadAt(p, 10); err != io.EOF {
+			t.Fatalf("ReadAt past the end = %v", err)
+		}
+	}
+}
+
+// benchmarkServe serves the same view repeatedly the way HTTP handlers
+// and StringSink callers do.
+func benchmarkServe(b *testing.B, view ByteView) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if s := view.String(); len(s) != view.Len() || !view.EqualString(s) {
+			b.Fatal("bad view")
+		}
+		if _, err := view.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkByteViewServeBytes(b *testing.B) {
+	benchmarkServe(b, ByteView{bytes: bytes.Repeat([]byte("x"), 1<<10)})
+}
+
+func BenchmarkByteViewServeString(b *testing.B) {
+	benchmarkServe(b, ByteView{str: string(bytes.Repeat([]byte("x"), 1<<10))})
+}
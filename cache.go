@@ -1,37 +1,411 @@
 package ocache
 
 import (
+	"encoding/binary"
+	"fmt"
+	"github.com/nohsueh/ocache/arena"
+	"github.com/nohsueh/ocache/disk"
 	"github.com/nohsueh/ocache/lru"
+	"log"
 	"sync"
+	"time"
 )
 
+// CacheStats are returned by Relation.CacheStats.
+type CacheStats struct {
+	Bytes int64
+	Items int64
+	Gets  int64
+	Hits  int64
+	// Evictions counts the entries dropped to make room, not the ones
+	// removed, expired or replaced.
+	Evictions  int64
+	Rejections int64
+	// L2Hits counts the gets served by the WithDiskStore tier,
+	// which holds L2Items entries in L2Bytes of log.
+	L2Hits  int64
+	L2Items int64
+	L2Bytes int64
+	// PoolShare is the fraction of the MemoryPool limit used by
+	// the relation, or 0 if it has not joined one.
+	PoolShare float64
+}
+
 type Cache struct {
 	mu    sync.Mutex
 	cache *lru.Cache
 	cap   int64
+	// store entries in an arena.Cache instead of cache when set.
+	// Only honored when cap is positive.
+	arena bool
+	slab  *arena.Cache
+	// largest share of cap a single entry may take, see lru.Cache.
+	maxEntryFraction float64
+	// bytes accounted to every entry on top of its key and value.
+	entryOverhead int64
+	// shared budget this cache draws from, if any.
+	pool *MemoryPool
+	// set once the cache left pool, it then stores nothing.
+	left bool
+	// second level that evicted entries move to, if any.
+	l2 *disk.Store
+	// set while entries are removed rather than evicted, so they are
+	// neither counted as evictions nor moved to l2.
+	removing bool
+	// the key being added, whose previous value lru.Cache.Add drops
+	// rather than evicts if the new one is rejected.
+	adding string
+
+	nget, nhit, nevict, nreject, nl2hit int64
+}
+
+func (c *Cache) useArena() bool {
+	return c.arena && c.cap > 0
+}
+
+// setCap changes the capacity, evicting the oldest entries if it shrinks.
+func (c *Cache) setCap(cap int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.arena && cap < arena.MinCap {
+		return fmt.Errorf("arena cache needs a capacity of at least %d bytes", arena.MinCap)
+	}
+	c.cap = cap
+	switch {
+	case c.slab != nil:
+		c.slab.Resize(cap)
+	case c.arena && c.cache != nil:
+		// the cache had no limit so far and kept its entries in an lru.Cache,
+		// move them to the arena from the oldest to the newest.
+		old := c.cache
+		c.cache = nil
+		old.Range(func(key string, v lru.Value) bool {
+			c.putLocked(key, v.(ByteView))
+			return true
+		})
+	case c.cache != nil:
+		c.cache.SetCap(cap)
+	}
+	return nil
+}
+
+func (c *Cache) capacity() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cap
 }
 
 func (c *Cache) add(key string, view ByteView) {
+	if pool := c.put(key, view); pool != nil {
+		pool.enforce()
+	}
+}
+
+// put adds the entry unless the cache left its pool, and returns the pool
+// to enforce, if any.
+func (c *Cache) put(key string, view ByteView) *MemoryPool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.left {
+		return nil
+	}
+	c.putLocked(key, view)
+	return c.pool
+}
+
+// leavePool takes the cache out of its MemoryPool and drops its entries,
+// which the pool no longer accounts for.
+func (c *Cache) leavePool() {
+	c.mu.Lock()
+	pool := c.pool
+	c.pool, c.left = nil, pool != nil
+	c.mu.Unlock()
+	if pool != nil {
+		pool.leave(c)
+		// the pool doesn't account for l2, leave it alone.
+		c.mu.Lock()
+		c.dropMemoryLocked()
+		c.mu.Unlock()
+	}
+}
+
+func (c *Cache) putLocked(key string, view ByteView) {
+	if c.l2 != nil {
+		// the new value supersedes any copy in l2.
+		c.l2Remove(key)
+	}
+
+	if c.useArena() {
+		if c.slab == nil {
+			c.slab = arena.New(c.cap, func(key string, value []byte) {
+				c.nevict++
+				c.spill(key, value)
+			})
+		}
+		if !c.slab.Add(key, arenaValue(view)) {
+			c.nreject++
+		}
+		return
+	}
 
 	if c.cache == nil {
-		c.cache = lru.New(c.cap, nil)
+		c.cache = lru.New(c.cap, func(key string, v lru.Value) {
+			if c.removing || key == c.adding {
+				return
+			}
+			c.nevict++
+			if c.l2 != nil {
+				c.spill(key, arenaValue(v.(ByteView)))
+			}
+		})
+		c.cache.MaxEntryFraction = c.maxEntryFraction
+		c.cache.EntryOverhead = c.entryOverhead
+		c.cache.OnRejected = func(string, lru.Value) {
+			c.nreject++
+		}
 	}
+	c.adding = key
 	c.cache.Add(key, view)
+	c.adding = ""
+}
+
+// spill moves an evicted entry, encoded by arenaValue, to l2.
+func (c *Cache) spill(key string, value []byte) {
+	if c.l2 == nil || arenaView(value).expired(time.Now()) {
+		return
+	}
+	if err := c.l2.Put(key, value); err != nil {
+		log.Println("[Cache] Failed to write to disk store", err)
+	}
+}
+
+func (c *Cache) l2Remove(key string) {
+	if err := c.l2.Remove(key); err != nil {
+		log.Println("[Cache] Failed to remove from disk store", err)
+	}
 }
 
+// l2Get moves an entry found in l2 back to memory.
+func (c *Cache) l2Get(key string) (view ByteView, ok bool) {
+	b, ok, err := c.l2.Get(key)
+	if err != nil {
+		log.Println("[Cache] Failed to read from disk store", err)
+	}
+	if !ok {
+		return ByteView{}, false
+	}
+	view = arenaView(b)
+	if view.expired(time.Now()) {
+		c.l2Remove(key)
+		return ByteView{}, false
+	}
+	c.nl2hit++
+	c.putLocked(key, view)
+	return view, true
+}
+
+// get returns the cached view for key. Expired views are dropped and
+// reported as misses.
 func (c *Cache) get(key string) (view ByteView, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.nget++
 
-	if c.cache == nil {
+	switch {
+	case c.useArena() && c.slab != nil:
+		var b []byte
+		if b, ok = c.slab.Get(key); ok {
+			view = arenaView(b)
+		}
+	case !c.useArena() && c.cache != nil:
+		var v lru.Value
+		if v, ok = c.cache.Get(key); ok {
+			view = v.(ByteView)
+		}
+	}
+	if !ok && c.l2 != nil {
+		view, ok = c.l2Get(key)
+	}
+	if !ok {
 		return
 	}
 
-	if v, ok := c.cache.Get(key); ok {
-		return v.(ByteView), ok
+	if view.expired(time.Now()) {
+		c.removeLocked(key)
+		return ByteView{}, false
+	}
+	c.nhit++
+	return view, true
+}
+
+func (c *Cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *Cache) removeLocked(key string) {
+	switch {
+	case c.slab != nil:
+		c.slab.Remove(key)
+	case c.cache != nil:
+		c.removing = true
+		c.cache.Remove(key)
+		c.removing = false
+	}
+	if c.l2 != nil {
+		c.l2Remove(key)
+	}
+}
+
+// purge removes every entry and returns how many there were in memory.
+func (c *Cache) purge() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.dropMemoryLocked()
+	if c.l2 != nil {
+		if err := c.l2.Clear(); err != nil {
+			log.Println("[Cache] Failed to clear disk store", err)
+		}
+	}
+	return n
+}
+
+// dropMemoryLocked drops the in-memory entries, without moving them to l2,
+// and returns how many there were.
+func (c *Cache) dropMemoryLocked() int64 {
+	var n int64
+	switch {
+	case c.slab != nil:
+		n = int64(c.slab.Len())
+	case c.cache != nil:
+		n = int64(c.cache.Len())
 	}
+	// the next put allocates them again.
+	c.slab, c.cache = nil, nil
+	return n
+}
+
+// cacheEntry is a key and its view, as listed by entries.
+type cacheEntry struct {
+	key  string
+	view ByteView
+}
+
+// entries lists the cached entries from the oldest to the newest, without
+// counting as gets.
+func (c *Cache) entries() []cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []cacheEntry
+	switch {
+	case c.slab != nil:
+		list = make([]cacheEntry, 0, c.slab.Len())
+		c.slab.Range(func(key string, value []byte) bool {
+			list = append(list, cacheEntry{key, arenaView(value)})
+			return true
+		})
+	case c.cache != nil:
+		list = make([]cacheEntry, 0, c.cache.Len())
+		c.cache.Range(func(key string, val lru.Value) bool {
+			list = append(list, cacheEntry{key, val.(ByteView)})
+			return true
+		})
+	}
+	return list
+}
+
+// arenaValue prefixes the view's bytes with its deadlines and encoding,
+// since an arena.Cache only stores bytes.
+func arenaValue(view ByteView) []byte {
+	n := 17 + len(view.encoding)
+	b := make([]byte, n+view.Len())
+	binary.LittleEndian.PutUint64(b[0:], uint64(unixNano(view.stale)))
+	binary.LittleEndian.PutUint64(b[8:], uint64(unixNano(view.expire)))
+	b[16] = byte(len(view.encoding))
+	copy(b[17:], view.encoding)
+	view.Copy(b[n:])
+	return b
+}
+
+// arenaView is the inverse of arenaValue.
+func arenaView(b []byte) ByteView {
+	n := 17 + int(b[16])
+	return ByteView{
+		bytes:    b[n:],
+		stale:    fromUnixNano(int64(binary.LittleEndian.Uint64(b[0:]))),
+		expire:   fromUnixNano(int64(binary.LittleEndian.Uint64(b[8:]))),
+		encoding: string(b[17:n]),
+	}
+}
 
-	return
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// evictOldest evicts a single entry and returns the number of bytes freed.
+func (c *Cache) evictOldest() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	before := c.bytesLocked()
+	switch {
+	case c.slab != nil:
+		c.slab.Eviction()
+	case c.cache != nil:
+		c.cache.Eviction()
+	}
+	return before - c.bytesLocked()
+}
+
+func (c *Cache) bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytesLocked()
+}
+
+func (c *Cache) bytesLocked() int64 {
+	switch {
+	case c.slab != nil:
+		return c.slab.Size()
+	case c.cache != nil:
+		return c.cache.Size()
+	}
+	return 0
+}
+
+func (c *Cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{
+		Gets:       c.nget,
+		Hits:       c.nhit,
+		Evictions:  c.nevict,
+		Rejections: c.nreject,
+	}
+	s.Bytes = c.bytesLocked()
+	switch {
+	case c.slab != nil:
+		s.Items = int64(c.slab.Len())
+	case c.cache != nil:
+		s.Items = int64(c.cache.Len())
+	}
+	if c.l2 != nil {
+		s.L2Hits = c.nl2hit
+		s.L2Items = int64(c.l2.Len())
+		s.L2Bytes = c.l2.Size()
+	}
+	if c.pool != nil {
+		s.PoolShare = float64(s.Bytes) / float64(c.pool.limit)
+	}
+	return s
 }
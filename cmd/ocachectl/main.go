@@ -0,0 +1,412 @@
+// Command ocachectl operates the nodes of an ocache cluster over the HTTP
+// protocol their HTTPPools serve.
+//
+// Usage:
+//
+//	ocachectl [flags] <command> [arguments]
+//
+// The commands are:
+//
+//	get <relation> <key>          print the value of key, loaded through the node
+//	set <relation> <key> [value]  cache value, or stdin, on the owner of key
+//	del <relation> <key>          drop key from the cache of its owner
+//	stats [relation]              print the stats of the node's relations
+//	ring <key>                    print the peer owning key
+//	peers                         print the peers, their share of keys and status
+//	dump <relation> [file]        save a snapshot of the node's cache of relation
+//	bench [-n N] [-c C] [-keys K] <relation>
+//	                              load the node with N gets of K keys, C at a time
+//
+// Nodes using HMACAuth or mutual TLS need the -secret and -id, the key the
+// nodes have for that identity, or the -cacert, -cert and -key flags. set
+// and del also need the -id, or the certificate's peer, to be one of the
+// node's admins.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nohsueh/ocache"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ocachectl:", err)
+		os.Exit(1)
+	}
+}
+
+// client talks to the nodes of a cluster.
+type client struct {
+	node string // base URL of the node commands go to
+	path string // base path of the nodes' HTTPPools
+	http *http.Client
+	auth ocache.Authenticator
+}
+
+// relationStats is an entry of the _admin/relations response.
+type relationStats struct {
+	Relation string `json:"relation"`
+	Capacity int64  `json:"capacity"`
+	Stats    ocache.CacheStats
+}
+
+type ringNode struct {
+	Peer         string  `json:"peer"`
+	VirtualNodes int     `json:"virtualNodes"`
+	Ownership    float64 `json:"ownership"`
+}
+
+type owner struct {
+	Key   string `json:"key"`
+	Owner string `json:"owner"`
+	Self  bool   `json:"self"`
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("ocachectl", flag.ContinueOnError)
+	node := flags.String("node", "http://localhost:8001", "base URL of the node to talk to")
+	path := flags.String("path", "/_ocache/", "base path of the nodes' HTTPPools")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of every request")
+	secret := flags.String("secret", "", "HMACAuth key of the -id identity")
+	id := flags.String("id", "ocachectl", "HMACAuth identity to sign requests with")
+	caCert := flags.String("cacert", "", "PEM file of the CA the nodes' certificates are verified with")
+	cert := flags.String("cert", "", "PEM file of the client certificate for mutual TLS")
+	key := flags.String("key", "", "PEM file of the client certificate's key")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: ocachectl [flags] get|set|del|stats|ring|peers|dump|bench [arguments]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no command")
+	}
+
+	c := &client{
+		node: strings.TrimSuffix(*node, "/"),
+		path: "/" + strings.Trim(*path, "/") + "/",
+		http: &http.Client{Timeout: *timeout},
+	}
+	if *secret != "" {
+		c.auth = ocache.HMACAuth{Secret: []byte(*secret), ID: *id}
+	}
+	if *caCert != "" || *cert != "" {
+		config, err := tlsConfig(*caCert, *cert, *key)
+		if err != nil {
+			return err
+		}
+		c.http.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config}
+	}
+
+	cmd, args := flags.Arg(0), flags.Args()[1:]
+	switch cmd {
+	case "get":
+		if len(args) != 2 {
+			return errors.New("usage: get <relation> <key>")
+		}
+		value, err := c.get(c.node, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		_, err = stdout.Write(value)
+		return err
+	case "set":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("usage: set <relation> <key> [value]")
+		}
+		var value []byte
+		if len(args) == 3 {
+			value = []byte(args[2])
+		} else {
+			var err error
+			if value, err = io.ReadAll(stdin); err != nil {
+				return err
+			}
+		}
+		return c.onOwner(http.MethodPut, args[0], args[1], value)
+	case "del":
+		if len(args) != 2 {
+			return errors.New("usage: del <relation> <key>")
+		}
+		return c.onOwner(http.MethodDelete, args[0], args[1], nil)
+	case "stats":
+		if len(args) > 1 {
+			return errors.New("usage: stats [relation]")
+		}
+		return c.stats(stdout, args)
+	case "ring":
+		if len(args) != 1 {
+			return errors.New("usage: ring <key>")
+		}
+		o, err := c.owner(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s\t%s\n", o.Key, o.Owner)
+		return nil
+	case "peers":
+		if len(args) != 0 {
+			return errors.New("usage: peers")
+		}
+		return c.peers(stdout)
+	case "dump":
+		if len(args) != 1 && len(args) != 2 {
+			return errors.New("usage: dump <relation> [file]")
+		}
+		return c.dump(stdout, args)
+	case "bench":
+		return c.bench(stdout, args)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// do sends a request to the node at base and returns the response body,
+// or an error for any status but 2xx.
+func (c *client) do(method, base, path string, body io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, base+c.path+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.auth != nil {
+		if err := c.auth.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res.Body, nil
+}
+
+// getJSON decodes the JSON response to a GET of path on the node into v.
+func (c *client) getJSON(base, path string, v interface{}) error {
+	body, err := c.do(http.MethodGet, base, path, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// get loads the value of key as a peer would.
+func (c *client) get(base, relation, key string) ([]byte, error) {
+	body, err := c.do(http.MethodGet, base, url.PathEscape(relation)+"/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	// without an X-Ocache-Accept-Encoding header values come uncompressed.
+	res := &pb.Response{}
+	if err := proto.Unmarshal(b, res); err != nil {
+		return nil, fmt.Errorf("decoding response body: %v", err)
+	}
+	return res.Value, nil
+}
+
+func (c *client) owner(key string) (owner, error) {
+	var o owner
+	err := c.getJSON(c.node, "_admin/owner/"+url.PathEscape(key), &o)
+	return o, err
+}
+
+// onOwner sends an admin request for key to the peer owning it.
+func (c *client) onOwner(method, relation, key string, value []byte) error {
+	o, err := c.owner(key)
+	if err != nil {
+		return err
+	}
+	base := c.node
+	if !o.Self {
+		base = o.Owner
+	}
+	body, err := c.do(method, base,
+		"_admin/relations/"+url.PathEscape(relation)+"/keys/"+url.PathEscape(key),
+		bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+func (c *client) stats(stdout io.Writer, args []string) error {
+	var list []relationStats
+	if len(args) == 1 {
+		var s relationStats
+		if err := c.getJSON(c.node, "_admin/relations/"+url.PathEscape(args[0]), &s); err != nil {
+			return err
+		}
+		list = append(list, s)
+	} else if err := c.getJSON(c.node, "_admin/relations", &list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "RELATION\tCAPACITY\tBYTES\tITEMS\tGETS\tHITS\tEVICTIONS\tREJECTIONS\tL2HITS\t")
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", s.Relation, s.Capacity,
+			s.Stats.Bytes, s.Stats.Items, s.Stats.Gets, s.Stats.Hits,
+			s.Stats.Evictions, s.Stats.Rejections, s.Stats.L2Hits)
+	}
+	return w.Flush()
+}
+
+func (c *client) peers(stdout io.Writer) error {
+	var ring struct {
+		Host  string     `json:"host"`
+		Nodes []ringNode `json:"nodes"`
+	}
+	if err := c.getJSON(c.node, "_admin/ring", &ring); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tVNODES\tOWNERSHIP\tSTATUS")
+	for _, n := range ring.Nodes {
+		base := n.Peer
+		if n.Peer == ring.Host {
+			base = c.node
+		}
+		var status struct {
+			Status string `json:"status"`
+		}
+		if err := c.getJSON(base, "_admin/status", &status); err != nil {
+			status.Status = "unreachable"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%s\n", n.Peer, n.VirtualNodes, 100*n.Ownership, status.Status)
+	}
+	return w.Flush()
+}
+
+func (c *client) dump(stdout io.Writer, args []string) error {
+	body, err := c.do(http.MethodGet, c.node, "_admin/snapshot/"+url.PathEscape(args[0]), nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if len(args) == 1 {
+		_, err = io.Copy(stdout, body)
+		return err
+	}
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *client) bench(stdout io.Writer, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	n := flags.Int("n", 1000, "number of gets")
+	concurrency := flags.Int("c", 10, "number of gets in flight")
+	keys := flags.Int("keys", 100, "number of distinct keys, key0 to keyK-1")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *n <= 0 || *concurrency <= 0 || *keys <= 0 {
+		return errors.New("usage: bench [-n N] [-c C] [-keys K] <relation>")
+	}
+	relation := flags.Arg(0)
+
+	latencies := make([]time.Duration, *n)
+	errs := make([]error, *n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := time.Now()
+				_, errs[i] = c.get(c.node, relation, fmt.Sprintf("key%d", i%*keys))
+				latencies[i] = time.Since(t)
+			}
+		}()
+	}
+	for i := 0; i < *n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	failed := 0
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Fprintf(stdout, "%d gets in %v, %.0f/s, %d failed\n",
+		*n, elapsed.Round(time.Millisecond), float64(*n)/elapsed.Seconds(), failed)
+	fmt.Fprintf(stdout, "latency p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1])
+	if firstErr != nil {
+		fmt.Fprintln(stdout, "first error:", firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"github.com/nohsueh/ocache"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_Commands(t *testing.T) {
+	r := ocache.NewRelation("ctl scores", 0, ocache.GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("loaded " + key), nil
+		},
+	))
+	var pool *ocache.HTTPPool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pool.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	pool = ocache.NewHTTPPool(srv.URL, ocache.WithAuth(ocache.HMACAuth{Keys: map[string][]byte{
+		"ocachectl": []byte("secret"),
+		"reader":    []byte("reader secret"),
+	}}), ocache.WithAdmins("ocachectl"))
+	pool.Set(srv.URL)
+	r.RegisterPeers(pool)
+
+	flags := []string{"-node", srv.URL, "-secret", "secret"}
+	ctl := func(stdin string, args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := run(append(flags, args...), strings.NewReader(stdin), &out); err != nil {
+			t.Fatalf("ocachectl %s: %v", strings.Join(args, " "), err)
+		}
+		return out.String()
+	}
+
+	if out := ctl("", "get", "ctl scores", "a/b"); out != "loaded a/b" {
+		t.Fatalf("get = %q", out)
+	}
+	ctl("", "set", "ctl scores", "k", "set value")
+	ctl("from stdin", "set", "ctl scores", "stdin")
+	if out := ctl("", "get", "ctl scores", "k"); out != "set value" {
+		t.Fatalf("get after set = %q", out)
+	}
+	if out := ctl("", "get", "ctl scores", "stdin"); out != "from stdin" {
+		t.Fatalf("get after set from stdin = %q", out)
+	}
+	ctl("", "del", "ctl scores", "k")
+	if out := ctl("", "get", "ctl scores", "k"); out != "loaded k" {
+		t.Fatalf("get after del = %q", out)
+	}
+
+	if out := ctl("", "stats", "ctl scores"); !strings.Contains(out, "ctl scores") || !strings.Contains(out, "ITEMS") {
+		t.Fatalf("stats = %q", out)
+	}
+	if out := ctl("", "ring", "k"); out != "k\t"+srv.URL+"\n" {
+		t.Fatalf("ring = %q", out)
+	}
+	if out := ctl("", "peers"); !strings.Contains(out, srv.URL) || !strings.Contains(out, "100.00%") || !strings.Contains(out, "serving") {
+		t.Fatalf("peers = %q", out)
+	}
+
+	file := filepath.Join(t.TempDir(), "dump")
+	ctl("", "dump", "ctl scores", file)
+	snapshot, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(snapshot), "OCSNAP") {
+		t.Fatalf("dump = %.20q", snapshot)
+	}
+
+	if out := ctl("", "bench", "-n", "50", "-c", "4", "-keys", "5", "ctl scores"); !strings.Contains(out, "50 gets") || !strings.Contains(out, "0 failed") {
+		t.Fatalf("bench = %q", out)
+	}
+
+	if err := run(append(flags, "get", "nope", "k"), nil, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("get of a missing relation = %v", err)
+	}
+	if err := run([]string{"-node", srv.URL, "-secret", "reader secret", "-id", "reader", "del", "ctl scores", "k"}, nil, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("del by a non-admin = %v", err)
+	}
+	if err := run([]string{"frobnicate"}, nil, &bytes.Buffer{}); err == nil {
+		t.Fatalf("unknown command succeeded")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// config is the configuration file of a node. It is JSON only: YAML and
+// TOML would need parsers from outside the standard library.
+//
+//	{
+//		"listen": ":8001",
+//		"self": "http://10.0.0.1:8001",
+//		"peers": ["http://10.0.0.1:8001", "http://10.0.0.2:8001"],
+//		"api": "/api",
+//		"relations": [{
+//			"name": "users",
+//			"capacity": 67108864,
+//			"expiry": {"soft": "1m", "hard": "1h"},
+//			"source": {"http": "http://users.internal/users/{key}"}
+//		}]
+//	}
+type config struct {
+	// Listen is the address to serve on, e.g. ":8001".
+	Listen string `json:"listen"`
+	// Self is this node's base URL as it appears in Peers.
+	Self  string   `json:"self"`
+	Peers []string `json:"peers"`
+	// API is the path prefix to serve ocache.APIHandler below, if any.
+	// It verifies requests with Auth, and lets APIWriters PUT and DELETE.
+	API        string   `json:"api,omitempty"`
+	APIWriters []string `json:"apiWriters,omitempty"`
+	// LeaseTimeout enables ocache.WithLoadLeases.
+	LeaseTimeout duration `json:"leaseTimeout,omitempty"`
+	// Rebalance enables ocache.WithRebalancing at RebalanceRate bytes per
+	// second, 0 for no limit. Peers must identify one another, with
+	// tls.verifyPeers or with auth.keys and self as auth.id.
+	Rebalance     bool  `json:"rebalance,omitempty"`
+	RebalanceRate int64 `json:"rebalanceRate,omitempty"`
+	// ShutdownTimeout bounds the drain on SIGINT or SIGTERM, 30s if 0.
+	ShutdownTimeout duration `json:"shutdownTimeout,omitempty"`
+
+	Auth *authConfig `json:"auth,omitempty"`
+	TLS  *tlsConfig  `json:"tls,omitempty"`
+	// Admins are the identities that may change relations through the
+	// admin endpoints, see ocache.WithAdmins.
+	Admins    []string         `json:"admins,omitempty"`
+	Relations []relationConfig `json:"relations"`
+}
+
+// authConfig enables ocache.HMACAuth. The node signs with Secret as ID,
+// and verifies requests with the key of the ID they claim in Keys. Without
+// Keys, requests are verified with Secret and carry no identity, which
+// admins, readers and apiWriters need.
+type authConfig struct {
+	Secret string            `json:"secret"`
+	ID     string            `json:"id"`
+	Keys   map[string]string `json:"keys,omitempty"`
+	Window duration          `json:"window,omitempty"`
+}
+
+// tlsConfig enables ocache.WithTLS, with certificates reloaded by an
+// ocache.CertReloader. With CA, peers must present a client certificate
+// issued by it. VerifyPeers enables ocache.WithPeerVerification and needs CA.
+type tlsConfig struct {
+	Cert        string `json:"cert"`
+	Key         string `json:"key"`
+	CA          string `json:"ca,omitempty"`
+	VerifyPeers bool   `json:"verifyPeers,omitempty"`
+}
+
+type relationConfig struct {
+	Name     string `json:"name"`
+	Capacity int64  `json:"capacity"`
+	Expiry   struct {
+		Soft duration `json:"soft,omitempty"`
+		Hard duration `json:"hard,omitempty"`
+	} `json:"expiry,omitempty"`
+	RefreshAhead duration `json:"refreshAhead,omitempty"`
+	MaxValueSize int64    `json:"maxValueSize,omitempty"`
+	// Compression is the name of the compressor, only "gzip" for now.
+	Compression string `json:"compression,omitempty"`
+	Snapshot    *struct {
+		Path     string   `json:"path"`
+		Interval duration `json:"interval,omitempty"`
+	} `json:"snapshot,omitempty"`
+	// Readers enables ocache.WithReaders.
+	Readers []string     `json:"readers,omitempty"`
+	Source  sourceConfig `json:"source"`
+}
+
+// sourceConfig is where a relation loads values from, exactly one of:
+//
+//	http     a URL with "{key}" standing for the escaped key, loaded by an
+//	         ocache.HTTPOriginGetter
+//	dir      a directory with a file per key
+//	command  a command run with the key as last argument, printing the value;
+//	         keys starting with "-" are not found, rather than taken as options
+type sourceConfig struct {
+	HTTP    string   `json:"http,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+	Command []string `json:"command,omitempty"`
+	// Timeout bounds every load, 10s if 0.
+	Timeout duration `json:"timeout,omitempty"`
+	// Concurrency limits the requests in flight to an http source, no
+	// limit if 0. Retries is the number of times they are retried,
+	// ocache.DefaultOriginRetries if 0 and none if negative.
+	Concurrency int `json:"concurrency,omitempty"`
+	Retries     int `json:"retries,omitempty"`
+}
+
+// duration is a time.Duration written as a string like "1m30s" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads and checks the configuration file at path.
+func loadConfig(path string) (*config, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".toml":
+		return nil, fmt.Errorf("%s: %s configuration is not supported, use JSON", path, ext[1:])
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &c, nil
+}
+
+func (c *config) check() error {
+	if c.Listen == "" {
+		return errors.New("listen is required")
+	}
+	if _, err := url.Parse(c.Self); err != nil || c.Self == "" {
+		return fmt.Errorf("self must be this node's base URL")
+	}
+	found := false
+	for _, peer := range c.Peers {
+		if _, err := url.Parse(peer); err != nil {
+			return fmt.Errorf("bad peer %q: %v", peer, err)
+		}
+		found = found || peer == c.Self
+	}
+	if len(c.Peers) > 0 && !found {
+		return fmt.Errorf("self %s is not one of the peers", c.Self)
+	}
+	if c.Auth != nil && c.Auth.Secret == "" {
+		return errors.New("auth needs a secret")
+	}
+	if c.TLS != nil && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		return errors.New("tls needs a cert and a key")
+	}
+	if c.TLS != nil && c.TLS.VerifyPeers && c.TLS.CA == "" {
+		return errors.New("tls verifyPeers needs a ca to verify them with")
+	}
+	if c.Rebalance && (c.TLS == nil || !c.TLS.VerifyPeers) && (c.Auth == nil || c.Auth.Keys == nil || c.Auth.ID != c.Self) {
+		return errors.New("rebalance needs peers to identify one another, with tls verifyPeers or auth keys and self as id")
+	}
+
+	names := make(map[string]bool, len(c.Relations))
+	for _, rc := range c.Relations {
+		if rc.Name == "" {
+			return errors.New("every relation needs a name")
+		}
+		if names[rc.Name] {
+			return fmt.Errorf("relation %s is declared twice", rc.Name)
+		}
+		names[rc.Name] = true
+		if err := rc.check(); err != nil {
+			return fmt.Errorf("relation %s: %v", rc.Name, err)
+		}
+	}
+	return nil
+}
+
+func (rc *relationConfig) check() error {
+	if rc.Capacity < 0 {
+		return errors.New("capacity must not be negative")
+	}
+	if soft, hard := rc.Expiry.Soft, rc.Expiry.Hard; soft > 0 && hard > 0 && soft > hard {
+		return errors.New("soft expiry after hard expiry")
+	}
+	if rc.Compression != "" && rc.Compression != "gzip" {
+		return fmt.Errorf("unknown compression %q", rc.Compression)
+	}
+	if rc.Snapshot != nil && rc.Snapshot.Path == "" {
+		return errors.New("snapshot needs a path")
+	}
+	return rc.Source.check()
+}
+
+func (sc *sourceConfig) check() error {
+	n := 0
+	for _, set := range []bool{sc.HTTP != "", sc.Dir != "", len(sc.Command) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("source needs exactly one of http, dir and command")
+	}
+	if sc.HTTP != "" {
+		if _, err := url.Parse(sc.HTTP); err != nil {
+			return err
+		}
+		if !strings.Contains(sc.HTTP, "{key}") {
+			return errors.New(`http source needs "{key}" in its URL`)
+		}
+	}
+	return nil
+}
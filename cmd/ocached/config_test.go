@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ocached.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_LoadConfig(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{
+		"listen": ":8001",
+		"self": "http://a:8001",
+		"peers": ["http://a:8001", "http://b:8001"],
+		"leaseTimeout": "5s",
+		"relations": [{
+			"name": "users",
+			"capacity": 1024,
+			"expiry": {"soft": "1m", "hard": "1h"},
+			"source": {"http": "http://origin/users/{key}", "timeout": "2s"}
+		}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := c.Relations[0]
+	if time.Duration(c.LeaseTimeout) != 5*time.Second || rc.Capacity != 1024 ||
+		time.Duration(rc.Expiry.Hard) != time.Hour || time.Duration(rc.Source.Timeout) != 2*time.Second {
+		t.Fatalf("loaded %+v", c)
+	}
+
+	for _, tt := range []struct {
+		config, want string
+	}{
+		{`{"self": "http://a", "relations": []}`, "listen"},
+		{`{"listen": ":1", "self": "http://a", "peers": ["http://b"]}`, "not one of the peers"},
+		{`{"listen": ":1", "self": "http://a", "typo": 1}`, "unknown field"},
+		{`{"listen": ":1", "self": "http://a", "leaseTimeout": 5}`, "duration"},
+		{`{"listen": ":1", "self": "http://a", "relations": [{"name": "r", "source": {}}]}`, "exactly one"},
+		{`{"listen": ":1", "self": "http://a", "relations": [{"name": "r", "source": {"http": "http://origin/"}}]}`, "{key}"},
+		{`{"listen": ":1", "self": "http://a", "relations": [{"name": "r", "source": {"dir": "/d", "command": ["cat"]}}]}`, "exactly one"},
+		{`{"listen": ":1", "self": "http://a", "relations": [{"name": "r", "source": {"dir": "/d"}}, {"name": "r", "source": {"dir": "/d"}}]}`, "twice"},
+		{`{"listen": ":1", "self": "http://a", "relations": [{"name": "r", "compression": "zstd", "source": {"dir": "/d"}}]}`, "compression"},
+		{`{"listen": ":1", "self": "http://a", "relations": [{"name": "r", "expiry": {"soft": "2h", "hard": "1h"}, "source": {"dir": "/d"}}]}`, "soft expiry"},
+		{`{"listen": ":1", "self": "http://a", "tls": {"cert": "c.pem", "key": "k.pem", "verifyPeers": true}}`, "needs a ca"},
+		{`{"listen": ":1", "self": "http://a", "rebalance": true, "auth": {"secret": "s", "id": "a"}}`, "identify"},
+	} {
+		if _, err := loadConfig(writeConfig(t, tt.config)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("loadConfig(%s) = %v, want an error about %s", tt.config, err, tt.want)
+		}
+	}
+
+	yaml := filepath.Join(t.TempDir(), "ocached.yaml")
+	if err := os.WriteFile(yaml, []byte("listen: :8001\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(yaml); err == nil || !strings.Contains(err.Error(), "use JSON") {
+		t.Fatalf("loadConfig(%s) = %v, want an error about JSON", yaml, err)
+	}
+}
@@ -0,0 +1,311 @@
+// Command ocached runs an ocache node configured by a JSON file declaring
+// its peers and relations, and where each relation loads values from.
+//
+// Usage:
+//
+//	ocached -config ocached.json
+//
+// On SIGHUP the file is read again: the peers, the capacities and sources
+// of the relations, and new relations take effect right away; other
+// changes need a restart. On SIGINT or SIGTERM the node drains with
+// ocache.HTTPPool.Shutdown before exiting.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nohsueh/ocache"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+func main() {
+	path := flag.String("config", "ocached.json", "configuration file")
+	flag.Parse()
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := newNode(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{
+		Addr:      c.Listen,
+		Handler:   n.handler,
+		TLSConfig: n.pool.TLSConfig(),
+	}
+	go func() {
+		log.Println("Ocache is running at", c.Self)
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			c, err := loadConfig(*path)
+			if err != nil {
+				log.Println("[Config] Keeping the running configuration:", err)
+				continue
+			}
+			n.reload(c)
+			log.Println("[Config] Reloaded", *path)
+			continue
+		}
+
+		timeout := time.Duration(n.config.ShutdownTimeout)
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := n.pool.Shutdown(ctx); err != nil {
+			log.Println("Failed to drain:", err)
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Failed to stop serving:", err)
+		}
+		cancel()
+		return
+	}
+}
+
+// node is the pool and relations built from a config.
+type node struct {
+	pool    *ocache.HTTPPool
+	handler http.Handler
+
+	mu        sync.Mutex // guards config and relations
+	config    *config
+	relations map[string]*relation
+}
+
+type relation struct {
+	*ocache.Relation
+	source *swapGetter
+	config relationConfig
+}
+
+func newNode(c *config) (*node, error) {
+	var opts []ocache.PoolOption
+	if c.LeaseTimeout > 0 {
+		opts = append(opts, ocache.WithLoadLeases(time.Duration(c.LeaseTimeout)))
+	}
+	if c.Rebalance {
+		opts = append(opts, ocache.WithRebalancing(c.RebalanceRate))
+	}
+	var auth ocache.Authenticator
+	if c.Auth != nil {
+		hmac := ocache.HMACAuth{
+			Secret: []byte(c.Auth.Secret),
+			ID:     c.Auth.ID,
+			Window: time.Duration(c.Auth.Window),
+		}
+		if c.Auth.Keys != nil {
+			hmac.Keys = make(map[string][]byte, len(c.Auth.Keys))
+			for id, key := range c.Auth.Keys {
+				hmac.Keys[id] = []byte(key)
+			}
+		}
+		auth = hmac
+		opts = append(opts, ocache.WithAuth(auth))
+	}
+	if c.Admins != nil {
+		opts = append(opts, ocache.WithAdmins(c.Admins...))
+	}
+	if c.TLS != nil {
+		server, client, err := peerTLS(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, ocache.WithTLS(server, client))
+		if c.TLS.VerifyPeers {
+			opts = append(opts, ocache.WithPeerVerification())
+		}
+	}
+
+	n := &node{
+		pool:      ocache.NewHTTPPool(c.Self, opts...),
+		config:    c,
+		relations: make(map[string]*relation, len(c.Relations)),
+	}
+	n.pool.Set(peers(c)...)
+	for _, rc := range c.Relations {
+		if ocache.GetRelation(rc.Name) != nil {
+			return nil, fmt.Errorf("relation %s already exists", rc.Name)
+		}
+		n.addRelation(rc)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/_ocache/", n.pool)
+	if c.API != "" {
+		prefix := "/" + strings.Trim(c.API, "/")
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, ocache.APIHandler{Auth: auth, Writers: c.APIWriters}))
+	}
+	n.handler = mux
+	return n, nil
+}
+
+// peers returns the ring of c, which is only this node if it has no peers.
+func peers(c *config) []string {
+	if len(c.Peers) == 0 {
+		return []string{c.Self}
+	}
+	return c.Peers
+}
+
+func peerTLS(c *tlsConfig) (server, client *tls.Config, err error) {
+	certs, err := ocache.NewCertReloader(c.Cert, c.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	server = &tls.Config{GetCertificate: certs.GetCertificate}
+	client = &tls.Config{GetClientCertificate: certs.GetClientCertificate}
+	if c.VerifyPeers && c.CA == "" {
+		// without a CA no client certificate is requested, and there would
+		// be no peer to identify.
+		return nil, nil, errors.New("tls verifyPeers needs a ca")
+	}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates in %s", c.CA)
+		}
+		server.ClientCAs, server.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		client.RootCAs = pool
+	}
+	return server, client, nil
+}
+
+func (n *node) addRelation(rc relationConfig) {
+	var opts []ocache.RelationOption
+	if rc.Expiry.Soft > 0 || rc.Expiry.Hard > 0 {
+		opts = append(opts, ocache.WithExpiry(time.Duration(rc.Expiry.Soft), time.Duration(rc.Expiry.Hard)))
+	}
+	if rc.RefreshAhead > 0 {
+		opts = append(opts, ocache.WithRefreshAhead(time.Duration(rc.RefreshAhead)))
+	}
+	if rc.MaxValueSize > 0 {
+		opts = append(opts, ocache.WithMaxValueSize(rc.MaxValueSize))
+	}
+	if rc.Compression == "gzip" {
+		opts = append(opts, ocache.WithCompression(ocache.GzipCompressor{}))
+	}
+	if rc.Snapshot != nil {
+		opts = append(opts, ocache.WithSnapshot(rc.Snapshot.Path, time.Duration(rc.Snapshot.Interval)))
+	}
+	if rc.Readers != nil {
+		opts = append(opts, ocache.WithReaders(rc.Readers...))
+	}
+
+	source := newSwapGetter(newSource(rc.Source))
+	r := &relation{
+		Relation: ocache.NewRelation(rc.Name, rc.Capacity, source, opts...),
+		source:   source,
+		config:   rc,
+	}
+	r.RegisterPeers(n.pool)
+	n.relations[rc.Name] = r
+}
+
+// reload applies what it can of a new configuration to the running node,
+// and logs the changes that need a restart.
+func (n *node) reload(c *config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !reflect.DeepEqual(restartOnly(n.config), restartOnly(c)) {
+		log.Println("[Config] Changes to the node other than its peers need a restart")
+	}
+	if !reflect.DeepEqual(peers(n.config), peers(c)) {
+		n.pool.Set(peers(c)...)
+		log.Println("[Config] Peers set to", peers(c))
+	}
+
+	declared := make(map[string]bool, len(c.Relations))
+	for _, rc := range c.Relations {
+		declared[rc.Name] = true
+		r, ok := n.relations[rc.Name]
+		if !ok {
+			if ocache.GetRelation(rc.Name) != nil {
+				log.Printf("[Config] Relation %s already exists", rc.Name)
+				continue
+			}
+			n.addRelation(rc)
+			log.Printf("[Config] Relation %s added", rc.Name)
+			continue
+		}
+
+		if rc.Capacity != r.config.Capacity {
+			if err := r.SetCapacity(rc.Capacity); err != nil {
+				log.Printf("[Config] Failed to resize relation %s: %v", rc.Name, err)
+				rc.Capacity = r.config.Capacity
+			}
+		}
+		if !reflect.DeepEqual(rc.Source, r.config.Source) {
+			r.source.set(newSource(rc.Source))
+		}
+		old, updated := r.config, rc
+		old.Capacity, old.Source = 0, sourceConfig{}
+		updated.Capacity, updated.Source = 0, sourceConfig{}
+		if !reflect.DeepEqual(old, updated) {
+			log.Printf("[Config] Changes to relation %s other than its capacity and source need a restart", rc.Name)
+		}
+		r.config.Capacity, r.config.Source = rc.Capacity, rc.Source
+	}
+	for name := range n.relations {
+		if !declared[name] {
+			log.Printf("[Config] Relation %s keeps serving until a restart", name)
+		}
+	}
+
+	// keep describing what runs: the rest applies after a restart only.
+	running := *n.config
+	running.Peers = c.Peers
+	running.Relations = nil
+	for _, rc := range c.Relations {
+		if r, ok := n.relations[rc.Name]; ok {
+			running.Relations = append(running.Relations, r.config)
+		}
+	}
+	for _, rc := range n.config.Relations {
+		if !declared[rc.Name] {
+			running.Relations = append(running.Relations, rc)
+		}
+	}
+	n.config = &running
+}
+
+// restartOnly returns the part of c that reload can't apply.
+func restartOnly(c *config) config {
+	r := *c
+	r.Peers, r.Relations = nil, nil
+	return r
+}
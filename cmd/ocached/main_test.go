@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_NodeReload(t *testing.T) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{"old/k": "old", "new/k": "new"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o700)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := loadConfig(writeConfig(t, `{
+		"listen": ":0",
+		"self": "http://self",
+		"api": "/api/",
+		"relations": [{"name": "files", "capacity": 1024, "source": {"dir": "`+dir+`/old"}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := newNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(n.handler)
+	defer srv.Close()
+	get := func(path string) string {
+		t.Helper()
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %s: %s", path, res.Status, b)
+		}
+		return string(b)
+	}
+	if v := get("/api/relations/files/keys/k"); v != "old" {
+		t.Fatalf("GET = %q, want old", v)
+	}
+
+	c, err = loadConfig(writeConfig(t, `{
+		"listen": ":0",
+		"self": "http://self",
+		"peers": ["http://self", "http://other"],
+		"api": "/api/",
+		"relations": [
+			{"name": "files", "capacity": 2048, "source": {"dir": "`+dir+`/new"}},
+			{"name": "more files", "capacity": 1024, "source": {"dir": "`+dir+`/new"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.reload(c)
+	files := n.relations["files"]
+	if files.Capacity() != 2048 {
+		t.Fatalf("capacity after reload = %d, want 2048", files.Capacity())
+	}
+	files.Purge()
+	if v, err := files.Get("k"); err != nil || v.String() != "new" {
+		t.Fatalf("Get after reload = %v, %v; want the new source", v, err)
+	}
+	if v := get("/api/relations/more%20files/keys/k"); v != "new" {
+		t.Fatalf("GET of the added relation = %q", v)
+	}
+	if v := get("/_ocache/_admin/ring"); !strings.Contains(v, `"http://other"`) {
+		t.Fatalf("ring after reload = %s", v)
+	}
+
+	// changes needing a restart are not taken as applied.
+	c.ShutdownTimeout = duration(time.Minute)
+	c.Relations[0].MaxValueSize = 1
+	n.reload(c)
+	if n.config.ShutdownTimeout != 0 || files.config.MaxValueSize != 0 {
+		t.Fatalf("reload recorded changes that need a restart: %+v", n.config)
+	}
+	if len(n.config.Relations) != 2 || n.config.Relations[0].Capacity != 2048 {
+		t.Fatalf("running relations after reload = %+v", n.config.Relations)
+	}
+}
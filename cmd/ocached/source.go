@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/nohsueh/ocache"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultSourceTimeout = 10 * time.Second
+
+// newSource returns the Getter for a relation's source.
+func newSource(sc sourceConfig) ocache.Getter {
+	timeout := time.Duration(sc.Timeout)
+	if timeout <= 0 {
+		timeout = defaultSourceTimeout
+	}
+	switch {
+	case sc.HTTP != "":
+		opts := []ocache.OriginOption{
+			ocache.WithOriginClient(&http.Client{Timeout: timeout}),
+			ocache.WithOriginConcurrency(sc.Concurrency),
+		}
+		if sc.Retries != 0 {
+			retries := sc.Retries
+			if retries < 0 {
+				retries = 0
+			}
+			opts = append(opts, ocache.WithOriginRetries(retries, ocache.DefaultOriginBackoff))
+		}
+		return ocache.NewHTTPOriginGetter(sc.HTTP, opts...)
+	case sc.Dir != "":
+		return dirSource(sc.Dir)
+	default:
+		return &commandSource{args: sc.Command, timeout: timeout}
+	}
+}
+
+// dirSource reads the value of a key from the file of that name in the
+// directory. Keys that are not local paths, like "../x", are not found.
+type dirSource string
+
+func (d dirSource) Get(key string) ([]byte, error) {
+	if !filepath.IsLocal(key) {
+		return nil, fmt.Errorf("%w: %s", ocache.ErrNotFound, key)
+	}
+	b, err := os.ReadFile(filepath.Join(string(d), key))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ocache.ErrNotFound, key)
+	}
+	return b, err
+}
+
+// commandSource runs a command with the key as its last argument and
+// takes its standard output as the value. Keys starting with "-" are not
+// found, so that callers can't pass options to the command.
+type commandSource struct {
+	args    []string
+	timeout time.Duration
+}
+
+func (s *commandSource) Get(key string) ([]byte, error) {
+	if strings.HasPrefix(key, "-") {
+		return nil, fmt.Errorf("%w: %s", ocache.ErrNotFound, key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.args[0], append(s.args[1:], key)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v: %s", s.args[0], key, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// swapGetter is the Getter of a relation, whose source may be replaced
+// when the configuration is reloaded.
+type swapGetter struct {
+	getter atomic.Value // of getterBox
+}
+
+// getterBox lets sources of different types share the atomic.Value.
+type getterBox struct{ ocache.Getter }
+
+func newSwapGetter(g ocache.Getter) *swapGetter {
+	s := &swapGetter{}
+	s.set(g)
+	return s
+}
+
+func (s *swapGetter) set(g ocache.Getter) {
+	s.getter.Store(getterBox{g})
+}
+
+func (s *swapGetter) Get(key string) ([]byte, error) {
+	return s.getter.Load().(getterBox).Get(key)
+}
+
+// GetSink passes dest on to sources that are SinkGetters, like the
+// HTTPOriginGetter, which set the expiry of the values they load.
+func (s *swapGetter) GetSink(key string, dest ocache.Sink) error {
+	g := s.getter.Load().(getterBox).Getter
+	if sg, ok := g.(ocache.SinkGetter); ok {
+		return sg.GetSink(key, dest)
+	}
+	value, err := g.Get(key)
+	if err != nil {
+		return err
+	}
+	return dest.SetBytes(value, time.Time{})
+}
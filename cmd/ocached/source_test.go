@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"github.com/nohsueh/ocache"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Sources(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.EscapedPath() {
+		case "/items/a%2Fb":
+			w.Write([]byte("from origin"))
+		case "/items/broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer origin.Close()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("from dir"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		source  sourceConfig
+		key     string
+		want    string
+		wantErr error
+	}{
+		{sourceConfig{HTTP: origin.URL + "/items/{key}"}, "a/b", "from origin", nil},
+		{sourceConfig{HTTP: origin.URL + "/items/{key}"}, "missing", "", ocache.ErrNotFound},
+		{sourceConfig{HTTP: origin.URL + "/items/{key}", Retries: -1}, "broken", "", errAny},
+		{sourceConfig{Dir: dir}, "file", "from dir", nil},
+		{sourceConfig{Dir: dir}, "missing", "", ocache.ErrNotFound},
+		{sourceConfig{Dir: dir}, "../" + filepath.Base(dir) + "/file", "", ocache.ErrNotFound},
+		{sourceConfig{Command: []string{"echo", "-n", "from"}}, "command", "from command", nil},
+		{sourceConfig{Command: []string{"false"}}, "key", "", errAny},
+		{sourceConfig{Command: []string{"echo", "-n"}}, "-e", "", ocache.ErrNotFound},
+	} {
+		value, err := newSource(tt.source).Get(tt.key)
+		switch {
+		case tt.wantErr == nil && (err != nil || string(value) != tt.want):
+			t.Fatalf("%+v Get(%q) = %q, %v; want %q", tt.source, tt.key, value, err, tt.want)
+		case tt.wantErr == errAny && err == nil,
+			tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+			t.Fatalf("%+v Get(%q) = %q, %v; want error %v", tt.source, tt.key, value, err, tt.wantErr)
+		}
+	}
+}
+
+// errAny stands for any error in Test_Sources.
+var errAny = errors.New("any error")
+
+func Test_SwapGetter(t *testing.T) {
+	s := newSwapGetter(ocache.GetterFunc(func(key string) ([]byte, error) {
+		return []byte("old"), nil
+	}))
+	var value []byte
+	if err := s.GetSink("key", ocache.AllocatingByteSliceSink(&value)); err != nil || string(value) != "old" {
+		t.Fatalf("GetSink = %q, %v", value, err)
+	}
+	s.set(dirSource(t.TempDir()))
+	if _, err := s.Get("key"); !errors.Is(err, ocache.ErrNotFound) {
+		t.Fatalf("Get after set = %v, want the new source's error", err)
+	}
+
+	// the expiry of an HTTPOriginGetter's values is passed on.
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("new"))
+	}))
+	defer origin.Close()
+	s.set(newSource(sourceConfig{HTTP: origin.URL + "/{key}"}))
+	var view ocache.ByteView
+	if err := s.GetSink("key", ocache.ByteViewSink(&view)); err != nil || view.String() != "new" {
+		t.Fatalf("GetSink = %v, %v", view, err)
+	}
+	if d := time.Until(view.Expire()); d < 59*time.Second || d > time.Minute {
+		t.Fatalf("value expires in %v, want the origin's max-age", d)
+	}
+}
@@ -0,0 +1,86 @@
+package ocache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"google.golang.org/protobuf/proto"
+)
+
+// A Codec converts values of type T to and from the bytes a Relation
+// caches and sends between peers. Unmarshal is handed the cached bytes
+// themselves and must neither modify nor retain them.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec[T any] struct{}
+
+// Marshal implements Codec.
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (JSONCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob.
+type GobCodec[T any] struct{}
+
+// Marshal implements Codec.
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec.
+func (GobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// ProtoCodec encodes protobuf messages. T is a generated message pointer
+// type such as *ocachepb.Request.
+type ProtoCodec[T proto.Message] struct{}
+
+// Marshal implements Codec.
+func (ProtoCodec[T]) Marshal(v T) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (ProtoCodec[T]) Unmarshal(data []byte) (T, error) {
+	var zero T
+	v := zero.ProtoReflect().New().Interface().(T)
+	err := proto.Unmarshal(data, v)
+	return v, err
+}
+
+// StringCodec stores strings as their raw bytes.
+type StringCodec struct{}
+
+// Marshal implements Codec.
+func (StringCodec) Marshal(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+// Unmarshal implements Codec.
+func (StringCodec) Unmarshal(data []byte) (string, error) {
+	return string(data), nil
+}
+
+var (
+	_ Codec[int]    = JSONCodec[int]{}
+	_ Codec[int]    = GobCodec[int]{}
+	_ Codec[string] = StringCodec{}
+)
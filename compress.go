@@ -0,0 +1,152 @@
+package ocache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Compressor compresses cached values. Name identifies the compression
+// between peers, which must all register the same Compressors. Decompress
+// returns a reader of the decompressed src, so that values from peers can
+// be decompressed up to a size limit.
+type Compressor interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		"gzip": GzipCompressor{},
+	}
+)
+
+// RegisterCompressor makes a Compressor, e.g. one for snappy or zstd,
+// available for decoding values received from peers. Compressors passed
+// to WithCompression are registered automatically.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+func getCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+// WithCompression stores the relation's values compressed with c, so more
+// of them fit in cacheBytes, and sends them compressed to peers that accept
+// it. Values that don't shrink are stored as they are. Every Get pays for
+// decompressing the value.
+func WithCompression(c Compressor) RelationOption {
+	RegisterCompressor(c)
+	return func(r *Relation) {
+		r.compressor = c
+	}
+}
+
+// GzipCompressor compresses with compress/gzip at Level, or at
+// gzip.DefaultCompression if Level is 0.
+type GzipCompressor struct {
+	Level int
+}
+
+// Name implements Compressor.
+func (GzipCompressor) Name() string {
+	return "gzip"
+}
+
+// Compress implements Compressor.
+func (g GzipCompressor) Compress(src []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor.
+func (GzipCompressor) Decompress(src io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(src)
+}
+
+var _ Compressor = GzipCompressor{}
+
+// encode compresses a plain view with the relation's Compressor.
+func (r *Relation) encode(view ByteView) ByteView {
+	if r.compressor == nil || view.encoding != "" {
+		return view
+	}
+	b, err := r.compressor.Compress(view.rawBytes())
+	if err != nil || len(b) >= view.Len() {
+		return view
+	}
+	view.bytes, view.str, view.encoding = b, "", r.compressor.Name()
+	return view
+}
+
+// decode is the inverse of encode, for views of any encoding. It fails
+// with ErrValueTooLarge rather than decompress more than max bytes, if max
+// is positive.
+func decode(view ByteView, max int64) (ByteView, error) {
+	if view.encoding == "" {
+		return view, nil
+	}
+	c, ok := getCompressor(view.encoding)
+	if !ok {
+		return ByteView{}, fmt.Errorf("unknown encoding %q", view.encoding)
+	}
+	rc, err := c.Decompress(bytes.NewReader(view.rawBytes()))
+	if err != nil {
+		return ByteView{}, fmt.Errorf("decoding %s value: %v", view.encoding, err)
+	}
+	defer rc.Close()
+	var src io.Reader = rc
+	if max > 0 {
+		src = io.LimitReader(rc, max+1)
+	}
+	b, err := io.ReadAll(src)
+	if err != nil {
+		return ByteView{}, fmt.Errorf("decoding %s value: %v", view.encoding, err)
+	}
+	if max > 0 && int64(len(b)) > max {
+		return ByteView{}, fmt.Errorf("%w: %s value decodes to more than %d bytes", ErrValueTooLarge, view.encoding, max)
+	}
+	view.bytes, view.str, view.encoding = b, "", ""
+	return view, nil
+}
+
+// acceptEncoding lists the encodings the relation asks peers for.
+func (r *Relation) acceptEncoding() []string {
+	if r.compressor == nil {
+		return nil
+	}
+	return []string{r.compressor.Name()}
+}
+
+func accepts(encodings []string, encoding string) bool {
+	for _, e := range encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
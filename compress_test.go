@@ -0,0 +1,50 @@
+package ocache
+
+import (
+	"bytes"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Compression(t *testing.T) {
+	value := bytes.Repeat([]byte("compressible "), 1<<10)
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return value, nil
+	})
+
+	plain := NewRelation("Plain", 1<<20, getter)
+	r := NewRelation("Compressed", 1<<20, getter, WithCompression(GzipCompressor{}))
+	for _, rel := range []*Relation{plain, r} {
+		if view, err := rel.Get("key"); err != nil || !view.EqualBytes(value) {
+			t.Fatalf("%s: Get = %d bytes, %v", rel.name, view.Len(), err)
+		}
+	}
+	if c, p := r.CacheStats().Bytes, plain.CacheStats().Bytes; c >= p/10 {
+		t.Fatalf("compressed entry takes %d bytes, plain %d", c, p)
+	}
+	if view, ok := r.cache.get("key"); !ok || view.encoding != "gzip" || view.Len() >= len(value) {
+		t.Fatalf("cached view is not compressed: %q, %d bytes", view.encoding, view.Len())
+	}
+
+	srv := httptest.NewServer(NewHTTPPool("http://server"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+	for _, accept := range [][]string{nil, {"snappy", "gzip"}} {
+		res := &pb.Response{}
+		if err := peer.Get(&pb.Request{Relation: "Compressed", Key: "key", AcceptEncoding: accept}, res); err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if accept != nil {
+			want = "gzip"
+		}
+		if res.Encoding != want {
+			t.Fatalf("accepting %q got encoding %q", accept, res.Encoding)
+		}
+		view, err := decode(ByteView{bytes: res.Value, encoding: res.Encoding}, 0)
+		if err != nil || !view.EqualBytes(value) {
+			t.Fatalf("accepting %q: decoded %d bytes, %v", accept, view.Len(), err)
+		}
+	}
+}
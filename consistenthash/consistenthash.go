@@ -62,3 +62,57 @@ func (m *Map) Get(key string) string {
 
 	return m.hashes[m.keys[i%len(m.keys)]]
 }
+
+// GetN gets up to n distinct items found walking the hash clockwise from
+// the provided key. The first one is the item Get returns.
+func (m *Map) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+
+	h := int(m.hash([]byte(key)))
+	start := sort.Search(len(m.keys),
+		func(i int) bool {
+			return m.keys[i] >= h
+		},
+	)
+
+	items := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(items) < n; i++ {
+		item := m.hashes[m.keys[(start+i)%len(m.keys)]]
+		if !seen[item] {
+			seen[item] = true
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// VirtualNodes returns the number of points each item has on the hash.
+// It is less than the number of replicas for an item whose hashes
+// collide with those of another item.
+func (m *Map) VirtualNodes() map[string]int {
+	counts := make(map[string]int)
+	for _, item := range m.hashes {
+		counts[item]++
+	}
+	return counts
+}
+
+// Ownership returns the fraction of the hash space each item is the
+// closest item for. The fractions add up to 1.
+func (m *Map) Ownership() map[string]float64 {
+	shares := make(map[string]float64)
+	if len(m.keys) == 0 {
+		return shares
+	}
+	const space = 1 << 32
+	// the first point also owns the arc that wraps past the last one.
+	prev := m.keys[len(m.keys)-1] - space
+	for _, k := range m.keys {
+		shares[m.hashes[k]] += float64(k-prev) / space
+		prev = k
+	}
+	return shares
+}
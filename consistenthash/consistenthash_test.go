@@ -1,6 +1,7 @@
 package consistenthash
 
 import (
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -39,3 +40,50 @@ func TestHashing(t *testing.T) {
 		}
 	}
 }
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+
+	// replicas with "hashes": 20, 21, 22, 40, 41, 42, 60, 61, 62
+	hash.Add("6", "4", "2")
+
+	testCases := map[string][]string{
+		"11": {"2", "4"},
+		"41": {"4", "6"},
+		"61": {"6", "2"},
+		"71": {"2", "4"},
+	}
+	for k, v := range testCases {
+		if got := hash.GetN(k, 2); !reflect.DeepEqual(got, v) {
+			t.Errorf("%v Asking for %s, should have yielded %v", got, k, v)
+		}
+	}
+
+	if got := hash.GetN("11", 5); len(got) != 3 {
+		t.Errorf("GetN beyond the number of items yielded %v", got)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	hash := New(2, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i) << 24
+	})
+
+	// replicas at 20, 21, 40 and 41 256ths of the hash space; 2 owns the
+	// arc that wraps around.
+	hash.Add("2", "4")
+
+	if got, want := hash.VirtualNodes(), map[string]int{"2": 2, "4": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("VirtualNodes() = %v, want %v", got, want)
+	}
+	if got, want := hash.Ownership(), map[string]float64{"2": 236.0 / 256, "4": 20.0 / 256}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ownership() = %v, want %v", got, want)
+	}
+	if got := New(2, nil).Ownership(); len(got) != 0 {
+		t.Errorf("Ownership() of an empty hash = %v", got)
+	}
+}
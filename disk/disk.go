@@ -0,0 +1,310 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// headerSize is the size of the header written before each record:
+// CRC-32C of the rest of the record (4 bytes), key length (4 bytes) and
+// value length (4 bytes, tombstone for a removal).
+const headerSize = 12
+
+// tombstone is the value length of a record that removes its key.
+const tombstone = math.MaxUint32
+
+// compactMinSize is how big a log without cap must grow before its dead
+// records are worth compacting away.
+const compactMinSize = 1 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Store is a key-value store kept in an append-only log file. Every Put
+// and Remove appends a record; an in-memory index points at the latest
+// record of each key. Compaction rewrites the log without the records
+// that are no longer referenced. It is safe for concurrent access.
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	cap   int64
+	size  int64 // bytes in the log
+	live  int64 // bytes of the records in index
+	index map[string]record
+}
+
+type record struct {
+	off  int64
+	size int64
+}
+
+// Open opens the store in the log file at path, creating it if needed.
+// The log may grow to cap bytes; compaction then keeps the most recently
+// written entries that fit in half of it. cap = 0 means no limit.
+// A torn record at the end of the log, left by a crash, is discarded.
+func Open(path string, cap int64) (*Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		path:  path,
+		f:     f,
+		cap:   cap,
+		index: make(map[string]record),
+	}
+	if err := s.recover(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover rebuilds the index from the log.
+func (s *Store) recover() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.f)
+	for {
+		key, value, size, err := readRecord(r, info.Size()-s.size)
+		if err != nil {
+			// keep everything before the first incomplete or corrupt
+			// record, later appends overwrite it.
+			return s.f.Truncate(s.size)
+		}
+		s.apply(key, value != nil, s.size, size)
+		s.size += size
+	}
+}
+
+// readRecord reads a record of at most max bytes. The value of a
+// tombstone is nil.
+func readRecord(r io.Reader, max int64) (key string, value []byte, size int64, err error) {
+	var hdr [headerSize]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	keyLen := binary.LittleEndian.Uint32(hdr[4:])
+	valLen := binary.LittleEndian.Uint32(hdr[8:])
+	n := int64(keyLen)
+	if valLen != tombstone {
+		n += int64(valLen)
+	}
+	if headerSize+n > max {
+		return "", nil, 0, errors.New("disk: record overruns the log")
+	}
+	body := make([]byte, n)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	crc := crc32.Update(crc32.Checksum(hdr[4:], crcTable), crcTable, body)
+	if crc != binary.LittleEndian.Uint32(hdr[0:]) {
+		return "", nil, 0, errors.New("disk: checksum mismatch")
+	}
+	key = string(body[:keyLen])
+	if valLen != tombstone {
+		value = body[keyLen:]
+	}
+	return key, value, headerSize + n, nil
+}
+
+func encodeRecord(key string, value []byte, remove bool) []byte {
+	n := len(key)
+	valLen := uint32(tombstone)
+	if !remove {
+		n += len(value)
+		valLen = uint32(len(value))
+	}
+	b := make([]byte, headerSize+n)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(b[8:], valLen)
+	copy(b[headerSize:], key)
+	if !remove {
+		copy(b[headerSize+len(key):], value)
+	}
+	binary.LittleEndian.PutUint32(b[0:], crc32.Checksum(b[4:], crcTable))
+	return b
+}
+
+// apply updates the index with a record of size bytes at off.
+func (s *Store) apply(key string, put bool, off, size int64) {
+	if old, ok := s.index[key]; ok {
+		s.live -= old.size
+		delete(s.index, key)
+	}
+	if put {
+		s.index[key] = record{off, size}
+		s.live += size
+	}
+}
+
+// Get look ups a key's value.
+func (s *Store) Get(key string) (value []byte, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	_, value, _, err = readRecord(io.NewSectionReader(s.f, rec.off, rec.size), rec.size)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Put stores value under key. An entry too big to ever fit in cap is not
+// stored, and removes any previous value of key.
+func (s *Store) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cap > 0 && int64(headerSize+len(key)+len(value)) > s.cap/2 {
+		return s.removeLocked(key)
+	}
+	if err := s.append(key, value, false); err != nil {
+		return err
+	}
+	if s.cap > 0 && s.size > s.cap {
+		return s.compact(s.cap / 2)
+	}
+	return nil
+}
+
+// Remove removes the provided key from the store.
+func (s *Store) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeLocked(key)
+}
+
+func (s *Store) removeLocked(key string) error {
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	if err := s.append(key, nil, true); err != nil {
+		return err
+	}
+	if s.size > compactMinSize && s.size-s.live > s.live {
+		return s.compact(0)
+	}
+	return nil
+}
+
+func (s *Store) append(key string, value []byte, remove bool) error {
+	b := encodeRecord(key, value, remove)
+	if _, err := s.f.WriteAt(b, s.size); err != nil {
+		return err
+	}
+	s.apply(key, !remove, s.size, int64(len(b)))
+	s.size += int64(len(b))
+	return nil
+}
+
+// Compact rewrites the log without dead records.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact(0)
+}
+
+// compact rewrites the log with the live records, dropping the oldest
+// until they take at most limit bytes. limit = 0 means no limit.
+func (s *Store) compact(limit int64) error {
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.index[keys[i]].off < s.index[keys[j]].off
+	})
+	live := s.live
+	for limit > 0 && live > limit {
+		live -= s.index[keys[0]].size
+		keys = keys[1:]
+	}
+
+	tmp := s.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]record, len(keys))
+	w := bufio.NewWriter(f)
+	var off int64
+	for _, key := range keys {
+		rec := s.index[key]
+		if _, err := io.Copy(w, io.NewSectionReader(s.f, rec.off, rec.size)); err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+		index[key] = record{off, rec.size}
+		off += rec.size
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	_ = s.f.Close()
+	s.f = f
+	s.index = index
+	s.size, s.live = off, off
+	return nil
+}
+
+// Clear removes every entry, truncating the log.
+func (s *Store) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	s.index = make(map[string]record)
+	s.size, s.live = 0, 0
+	return nil
+}
+
+// Close closes the log file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// Len the number of entries.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index)
+}
+
+// Size the number of bytes in the log, including dead records.
+func (s *Store) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Live the number of log bytes used by live entries.
+func (s *Store) Live() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.live
+}
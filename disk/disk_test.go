@@ -0,0 +1,114 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func open(t *testing.T, path string, cap int64) *Store {
+	s, err := Open(path, cap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func Test_Get(t *testing.T) {
+	s := open(t, filepath.Join(t.TempDir(), "log"), 0)
+	if err := s.Put("key1", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := s.Get("key1"); !ok || err != nil || string(v) != "1234" {
+		t.Fatalf("store hit key1=1234 failed")
+	}
+	if _, ok, _ := s.Get("key2"); ok {
+		t.Fatalf("store miss key2 failed")
+	}
+}
+
+func Test_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	s := open(t, path, 0)
+	s.Put("k1", []byte("v1"))
+	s.Put("k2", []byte("v2"))
+	s.Put("k1", []byte("v1'"))
+	s.Remove("k2")
+	s.Close()
+
+	// a record torn by a crash is dropped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5, 0, 0, 0, 9})
+	f.Close()
+
+	s = open(t, path, 0)
+	if v, ok, _ := s.Get("k1"); !ok || string(v) != "v1'" {
+		t.Fatalf("reopened k1 = %q, want the latest value", v)
+	}
+	if _, ok, _ := s.Get("k2"); ok || s.Len() != 1 {
+		t.Fatalf("removed k2 came back")
+	}
+	s.Put("k3", []byte("v3"))
+	s = open(t, path, 0)
+	if v, ok, _ := s.Get("k3"); !ok || string(v) != "v3" {
+		t.Fatalf("entry written after a torn record was lost")
+	}
+}
+
+func Test_Compaction(t *testing.T) {
+	const cap = 1 << 10
+	s := open(t, filepath.Join(t.TempDir(), "log"), cap)
+	for i := 0; i < 100; i++ {
+		if err := s.Put(fmt.Sprintf("key%02d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if s.Size() > cap {
+			t.Fatalf("log grew to %d bytes, cap is %d", s.Size(), cap)
+		}
+	}
+	if _, ok, _ := s.Get("key00"); ok {
+		t.Fatalf("oldest entry survived compaction")
+	}
+	if v, ok, _ := s.Get("key99"); !ok || string(v) != "value" {
+		t.Fatalf("newest entry lost by compaction")
+	}
+
+	s.Put("key99", []byte("again"))
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != s.Live() {
+		t.Fatalf("compacted log has %d dead bytes", s.Size()-s.Live())
+	}
+	if v, _, _ := s.Get("key99"); string(v) != "again" {
+		t.Fatalf("compaction kept a stale value")
+	}
+}
+
+func Test_Clear(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	s := open(t, path, 0)
+	s.Put("k1", []byte("v1"))
+	s.Put("k2", []byte("v2"))
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get("k1"); ok || s.Len() != 0 || s.Size() != 0 {
+		t.Fatalf("Clear kept %d entries in %d bytes", s.Len(), s.Size())
+	}
+	s.Put("k3", []byte("v3"))
+	s.Close()
+
+	s = open(t, path, 0)
+	if _, ok, _ := s.Get("k2"); ok {
+		t.Fatalf("cleared k2 came back after reopening")
+	}
+	if v, ok, _ := s.Get("k3"); !ok || string(v) != "v3" {
+		t.Fatalf("k3 = %q after reopening, want v3", v)
+	}
+}
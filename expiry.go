@@ -0,0 +1,85 @@
+package ocache
+
+import (
+	"log"
+	"time"
+)
+
+// WithExpiry gives loaded values a soft and a hard deadline. Once soft has
+// passed, Get keeps returning the cached value immediately but triggers a
+// single background refresh (stale-while-revalidate). Once hard has passed
+// the value is dropped and Get loads it again. Zero disables either one.
+func WithExpiry(soft, hard time.Duration) RelationOption {
+	if soft > 0 && hard > 0 && soft > hard {
+		panic("ocache: soft expiry after hard expiry")
+	}
+	return func(r *Relation) {
+		r.softTTL, r.hardTTL = soft, hard
+	}
+}
+
+// WithRefreshAhead refreshes a value in the background when it is read
+// within window of its soft (or, without one, hard) deadline, so that hot
+// keys are reloaded before they ever go stale.
+func WithRefreshAhead(window time.Duration) RelationOption {
+	return func(r *Relation) {
+		r.refreshAhead = window
+	}
+}
+
+// stamp sets the deadlines of a freshly loaded view. An expiry set by the
+// Getter through its Sink takes precedence over the relation's hard
+// expiry and caps its soft one.
+func (r *Relation) stamp(view *ByteView, now time.Time) {
+	if r.hardTTL > 0 && view.expire.IsZero() {
+		view.expire = now.Add(r.hardTTL)
+	}
+	if r.softTTL > 0 {
+		view.stale = now.Add(r.softTTL)
+		if !view.expire.IsZero() && view.stale.After(view.expire) {
+			view.stale = view.expire
+		}
+	}
+}
+
+// needsRefresh reports whether a cached view should be reloaded in the
+// background.
+func (r *Relation) needsRefresh(view ByteView, now time.Time) bool {
+	deadline := view.stale
+	if deadline.IsZero() {
+		deadline = view.expire
+	}
+	if deadline.IsZero() {
+		return false
+	}
+	if !view.stale.IsZero() && now.After(view.stale) {
+		return true
+	}
+	return r.refreshAhead > 0 && deadline.Sub(now) < r.refreshAhead
+}
+
+// refresh reloads key in the background unless a refresh for it is
+// already running. Concurrent foreground loads share it through loader.
+func (r *Relation) refresh(key string) {
+	r.refreshMu.Lock()
+	if _, ok := r.refreshing[key]; ok {
+		r.refreshMu.Unlock()
+		return
+	}
+	if r.refreshing == nil {
+		r.refreshing = make(map[string]struct{})
+	}
+	r.refreshing[key] = struct{}{}
+	r.refreshMu.Unlock()
+
+	go func() {
+		defer func() {
+			r.refreshMu.Lock()
+			delete(r.refreshing, key)
+			r.refreshMu.Unlock()
+		}()
+		if _, err := r.load(key); err != nil {
+			log.Println("[Cache] Failed to refresh", key, err)
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package ocache
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/nohsueh/ocache/consistenthash"
 	pb "github.com/nohsueh/ocache/ocachepb"
@@ -11,11 +12,16 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	defaultBasePath = "/_ocache/"
 	defaultReplicas = 50
+	// acceptEncodingHeader carries pb.Request.AcceptEncoding, the
+	// compressions a peer can decode. The response says which one it
+	// got in pb.Response.Encoding.
+	acceptEncodingHeader = "X-Ocache-Accept-Encoding"
 )
 
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
@@ -26,14 +32,54 @@ type HTTPPool struct {
 	mu          sync.Mutex // guards peers and httpGetters
 	peers       *consistenthash.Map
 	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+	// grants load leases for keys this peer coordinates, nil if disabled.
+	leases *leaseTable
+	// hands entries off after ring changes, nil if disabled.
+	rebalance *rebalancer
+	// signs and verifies requests between peers, nil if disabled.
+	auth Authenticator
+	// see WithTLS and WithPeerVerification.
+	serverTLS   *tls.Config
+	client      *http.Client // nil for http.DefaultClient
+	verifyPeers bool
+	// identities that may change relations, see WithAdmins.
+	admins map[string]bool
+	// names of the peers as passed to Set. Those in drained are out of
+	// the ring until the time they map to, see dropPeer.
+	members []string
+	drained map[string]time.Time
+	// see Shutdown.
+	drainMu  sync.Mutex // guards draining and active
+	draining bool
+	active   int           // requests being served
+	idle     chan struct{} // closed once draining and no longer active
+}
+
+// A PoolOption configures an HTTPPool created by NewHTTPPool.
+type PoolOption func(*HTTPPool)
+
+// WithLoadLeases enables cluster-wide coordination of fallback loads:
+// a peer that can't reach the owner of a key asks the next peer on the
+// ring for a lease before calling its Getter, so the backing store sees a
+// single load per key even while the owner is down. A lease not released
+// within timeout is handed to another peer. Every peer should enable it.
+func WithLoadLeases(timeout time.Duration) PoolOption {
+	return func(p *HTTPPool) {
+		p.leases = newLeaseTable(timeout)
+	}
 }
 
 // NewHTTPPool initializes an HTTP pool of peers.
-func NewHTTPPool(host string) *HTTPPool {
-	return &HTTPPool{
+func NewHTTPPool(host string, opts ...PoolOption) *HTTPPool {
+	p := &HTTPPool{
 		host: host,
 		path: defaultBasePath,
+		idle: make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 // Log info with server name.
@@ -43,34 +89,88 @@ func (p *HTTPPool) Log(format string, v ...interface{}) {
 
 // ServeHTTP handle all http requests.
 func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, request *http.Request) {
-	if !strings.HasPrefix(request.URL.Path, p.path) {
-		panic("HTTPPool serving unexpected path: " + request.URL.Path)
+	// route on the escaped path, relation names and keys may contain "/".
+	escaped := request.URL.EscapedPath()
+	if !strings.HasPrefix(escaped, p.path) {
+		http.NotFound(w, request)
+		return
 	}
 	p.Log("%s %s", request.Method, request.URL.Path)
-	// /<host>/<path>/<relation name>/<key> required
-	parts := strings.SplitN(request.URL.Path[len(p.path):], "/", 2)
-	if len(parts) != 2 {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	identity, ok := p.authenticate(w, request)
+	if !ok {
+		return
+	}
+	path := escaped[len(p.path):]
+	if strings.HasPrefix(path, adminPrefix) {
+		p.serveAdmin(w, request, identity, path[len(adminPrefix):])
+		return
+	}
+	if !p.enter() {
+		w.Header().Set(statusHeader, statusDraining)
+		http.Error(w, "Peer is draining", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.leave()
+	switch {
+	case strings.HasPrefix(path, leasePrefix):
+		p.serveLease(w, request, identity, path[len(leasePrefix):])
+		return
+	case path == transferPrefix:
+		p.serveTransfer(w, request, identity)
 		return
 	}
 
-	relationName := parts[0]
-	key := parts[1]
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// /<base path>/<relation name>/<key> required
+	relationName, key, err := parseKeyPath(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	r := GetRelation(relationName)
 	if r == nil {
 		http.Error(w, "No such r: "+relationName, http.StatusNotFound)
 		return
 	}
+	if !p.authorize(w, r, identity) {
+		return
+	}
 
-	view, err := r.Get(key)
+	view, err := r.get(key)
+	if err == nil && (view.encoding == "" ||
+		!accepts(strings.Split(request.Header.Get(acceptEncodingHeader), ","), view.encoding)) {
+		view, err = decode(view, r.maxValueSize)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if request.Header.Get("Accept") == streamContentType {
+		if view, err = decode(view, r.maxValueSize); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := writeStream(w, view); err != nil {
+			p.Log("Failed to stream %s: %v", key, err)
+		}
+		return
+	}
+
 	// Write the view to the response body as a proto message.
-	body, err := proto.Marshal(&pb.Response{Value: view.ByteSlice()})
+	// proto.Marshal only reads the value, so hand it the view's bytes
+	// rather than a copy.
+	body, err := proto.Marshal(&pb.Response{
+		Value:    view.rawBytes(),
+		Encoding: view.encoding,
+		Stale:    unixNano(view.stale),
+		Expire:   unixNano(view.expire),
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -83,18 +183,63 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// MaxKeyLength is the longest key, in bytes, HTTPPool and APIHandler serve.
+const MaxKeyLength = 4 << 10
+
+// keyURL returns the URL of the relation and key of in below base, both
+// escaped as path segments. parseKeyPath is its inverse.
+func keyURL(base string, in *pb.Request) string {
+	return base + url.PathEscape(in.GetRelation()) + "/" + url.PathEscape(in.GetKey())
+}
+
+// parseKeyPath splits an escaped <relation>/<key> path.
+func parseKeyPath(path string) (relation, key string, err error) {
+	escRelation, escKey, ok := strings.Cut(path, "/")
+	if !ok {
+		return "", "", fmt.Errorf("path must be <relation>/<key>")
+	}
+	if relation, err = url.PathUnescape(escRelation); err != nil {
+		return "", "", fmt.Errorf("bad relation: %v", err)
+	}
+	if key, err = url.PathUnescape(escKey); err != nil {
+		return "", "", fmt.Errorf("bad key: %v", err)
+	}
+	if relation == "" || key == "" {
+		return "", "", fmt.Errorf("relation and key are required")
+	}
+	if len(key) > MaxKeyLength {
+		return "", "", fmt.Errorf("key longer than %d bytes", MaxKeyLength)
+	}
+	return relation, key, nil
+}
+
 type httpGetter struct {
 	baseURL string
+	client  *http.Client
+	auth    Authenticator
+	// the pool that picked the peer, told when the peer drains.
+	pool *HTTPPool
+	peer string
 }
 
+// responseOverhead is the room a pb.Response takes besides its value.
+const responseOverhead = 1 << 10
+
 func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
-	u := fmt.Sprintf(
-		"%v%v/%v",
-		h.baseURL,
-		url.QueryEscape(in.GetRelation()),
-		url.QueryEscape(in.GetKey()),
-	)
-	res, err := http.Get(u)
+	return h.getLimited(in, out, 0)
+}
+
+// getLimited implements limitedGetter. A response too long for a value
+// of max bytes fails with ErrValueTooLarge once that much is read.
+func (h *httpGetter) getLimited(in *pb.Request, out *pb.Response, max int64) error {
+	req, err := http.NewRequest(http.MethodGet, keyURL(h.baseURL, in), nil)
+	if err != nil {
+		return err
+	}
+	if len(in.GetAcceptEncoding()) > 0 {
+		req.Header.Set(acceptEncodingHeader, strings.Join(in.GetAcceptEncoding(), ","))
+	}
+	res, err := do(h.client, h.auth, req)
 	if err != nil {
 		return err
 	}
@@ -105,14 +250,24 @@ func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
 		}
 	}(res.Body)
 
+	if h.isDraining(res) {
+		return ErrPeerDraining
+	}
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("server returned: %v", res.Status)
 	}
 
-	bytes, err := io.ReadAll(res.Body)
+	var body io.Reader = res.Body
+	if max > 0 {
+		body = io.LimitReader(res.Body, max+responseOverhead+1)
+	}
+	bytes, err := io.ReadAll(body)
 	if err != nil {
 		return fmt.Errorf("reading response body: %v", err)
 	}
+	if max > 0 && int64(len(bytes)) > max+responseOverhead {
+		return fmt.Errorf("%w: response longer than %d bytes", ErrValueTooLarge, max+responseOverhead)
+	}
 
 	if err = proto.Unmarshal(bytes, out); err != nil {
 		return fmt.Errorf("decoding response body: %v", err)
@@ -121,17 +276,43 @@ func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
 	return nil
 }
 
-var _ PeerGetter = (*httpGetter)(nil)
+var (
+	_ PeerGetter    = (*httpGetter)(nil)
+	_ limitedGetter = (*httpGetter)(nil)
+)
 
-// Set updates the pool's list of peers.
+// Set updates the pool's list of peers. With WithRebalancing, entries
+// whose owner changed are then handed off in the background.
 func (p *HTTPPool) Set(peers ...string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.setLocked(peers)
+}
+
+func (p *HTTPPool) setLocked(peers []string) {
+	p.members = append([]string(nil), peers...)
+	p.drained = nil
+	p.buildRingLocked()
+}
+
+// buildRingLocked builds the ring of the members that are not drained.
+func (p *HTTPPool) buildRingLocked() {
+	changed := p.peers != nil
+	peers := p.ringMembersLocked()
 	p.peers = consistenthash.New(defaultReplicas, nil)
 	p.peers.Add(peers...)
 	p.httpGetters = make(map[string]*httpGetter, len(peers))
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{baseURL: peer + p.path}
+		p.httpGetters[peer] = &httpGetter{
+			baseURL: peer + p.path,
+			client:  p.client,
+			auth:    p.auth,
+			pool:    p,
+			peer:    peer,
+		}
+	}
+	if changed && p.rebalance != nil {
+		p.startHandoff(p.peers)
 	}
 }
 
@@ -146,4 +327,15 @@ func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
 	return nil, false
 }
 
+// ringMembersLocked lists the members in the ring.
+func (p *HTTPPool) ringMembersLocked() []string {
+	peers := make([]string, 0, len(p.members))
+	for _, peer := range p.members {
+		if _, ok := p.drained[peer]; !ok {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
 var _ PeerPicker = (*HTTPPool)(nil)
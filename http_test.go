@@ -0,0 +1,662 @@
+package ocache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nohsueh/ocache/consistenthash"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_AdminCapacity(t *testing.T) {
+	r := NewRelation("Resize", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("value"), nil
+		},
+	))
+	for _, k := range []string{"k1", "k2", "k3"} {
+		if _, err := r.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool := NewHTTPPool("http://localhost:8001", WithAuth(HMACAuth{Keys: testKeys}), WithAdmins("admin"))
+	for _, id := range []string{"", "peer"} {
+		w := httptest.NewRecorder()
+		pool.ServeHTTP(w, signedRequest(t, http.MethodPut, defaultBasePath+"_admin/capacity/Resize?bytes=1", id, nil))
+		if w.Code == http.StatusOK || r.Capacity() != 0 {
+			t.Fatalf("resize as %q returned %d", id, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, signedRequest(t, http.MethodPut, defaultBasePath+"_admin/capacity/Resize?bytes=14", "admin", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("resize returned %d: %s", w.Code, w.Body)
+	}
+
+	var res relationResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Capacity != 14 || res.Stats.Items != 2 || r.Capacity() != 14 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+
+	for _, bytes := range []string{"-1", "0"} {
+		w = httptest.NewRecorder()
+		pool.ServeHTTP(w, signedRequest(t, http.MethodPut, defaultBasePath+"_admin/capacity/Resize?bytes="+bytes, "admin", nil))
+		if w.Code != http.StatusBadRequest || r.Capacity() != 14 {
+			t.Fatalf("capacity %s returned %d", bytes, w.Code)
+		}
+	}
+}
+
+// testKeys are the HMACAuth keys of the identities in tests.
+var testKeys = map[string][]byte{
+	"admin":  []byte("admin secret"),
+	"reader": []byte("reader secret"),
+	"writer": []byte("writer secret"),
+	"peer-a": []byte("secret a"),
+	"peer-b": []byte("secret b"),
+}
+
+// signedRequest returns a request signed with the key of id, or an
+// unsigned one if id is "".
+func signedRequest(t *testing.T, method, target, id string, body io.Reader) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, target, body)
+	if id != "" {
+		if err := (HMACAuth{Secret: testKeys[id], ID: id}).Sign(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return req
+}
+
+func Test_AdminIntrospection(t *testing.T) {
+	r := NewRelation("Introspect/1", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("value"), nil
+		},
+	))
+	for _, k := range []string{"k1", "k 2", "k3"} {
+		if _, err := r.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	NewRelation("Introspect/private", 0, r.getter, WithReaders("reader"))
+	pool := NewHTTPPool("http://self", WithAuth(HMACAuth{Keys: testKeys}), WithAdmins("admin"))
+	pool.Set("http://self", "http://other")
+
+	id := "admin"
+	admin := func(method, path string, want int, v interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		pool.ServeHTTP(w, signedRequest(t, method, defaultBasePath+"_admin/"+path, id, nil))
+		if w.Code != want {
+			t.Fatalf("%s %s returned %d: %s", method, path, w.Code, w.Body)
+		}
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var list []relationResponse
+	admin(http.MethodGet, "relations", http.StatusOK, &list)
+	found := false
+	for _, res := range list {
+		if res.Relation == "Introspect/1" {
+			found = res.Stats.Items == 3
+		}
+		if res.Relation == "Introspect/private" {
+			t.Fatalf("relations lists a relation admin may not read")
+		}
+	}
+	if !found {
+		t.Fatalf("relations = %+v, want Introspect/1 with 3 items", list)
+	}
+	admin(http.MethodGet, "relations/Introspect%2Fprivate", http.StatusForbidden, nil)
+
+	// only admins change relations.
+	id = "reader"
+	admin(http.MethodGet, "relations/Introspect%2Fprivate", http.StatusOK, nil)
+	admin(http.MethodDelete, "relations/Introspect%2F1/keys/k1", http.StatusForbidden, nil)
+	admin(http.MethodDelete, "relations/Introspect%2F1", http.StatusForbidden, nil)
+	if items := r.CacheStats().Items; items != 3 {
+		t.Fatalf("refused drops left %d items", items)
+	}
+	id = "admin"
+
+	var ring ringResponse
+	admin(http.MethodGet, "ring", http.StatusOK, &ring)
+	if len(ring.Nodes) != 2 || ring.Host != "http://self" {
+		t.Fatalf("ring = %+v", ring)
+	}
+	total := 0.0
+	for _, n := range ring.Nodes {
+		if n.VirtualNodes != defaultReplicas || n.Ownership <= 0 {
+			t.Fatalf("ring node = %+v", n)
+		}
+		total += n.Ownership
+	}
+	if total < 0.999 || total > 1.001 {
+		t.Fatalf("ownership adds up to %v", total)
+	}
+
+	var owner ownerResponse
+	admin(http.MethodGet, "owner/a%2Fkey", http.StatusOK, &owner)
+	if owner.Key != "a/key" || owner.Owner != pool.peers.Get("a/key") || owner.Self != (owner.Owner == "http://self") {
+		t.Fatalf("owner = %+v", owner)
+	}
+
+	var res relationResponse
+	admin(http.MethodDelete, "relations/Introspect%2F1/keys/k%202", http.StatusOK, &res)
+	if res.Stats.Items != 2 {
+		t.Fatalf("dropping a key left %d items", res.Stats.Items)
+	}
+	admin(http.MethodDelete, "relations/Introspect%2F1", http.StatusOK, &res)
+	if res.Purged != 2 || res.Stats.Items != 0 || r.CacheStats().Items != 0 {
+		t.Fatalf("purge = %+v", res)
+	}
+	if _, err := r.Get("k1"); err != nil || r.CacheStats().Items != 1 {
+		t.Fatalf("Get after purge: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, signedRequest(t, http.MethodPut,
+		defaultBasePath+"_admin/relations/Introspect%2F1/keys/k9", "admin", strings.NewReader("nine")))
+	if view, err := r.Get("k9"); w.Code != http.StatusOK || err != nil || view.String() != "nine" {
+		t.Fatalf("PUT returned %d, then Get = %v, %v", w.Code, view, err)
+	}
+	w = httptest.NewRecorder()
+	pool.ServeHTTP(w, signedRequest(t, http.MethodPut,
+		defaultBasePath+"_admin/relations/Introspect%2F1/keys/k9", "reader", strings.NewReader("overwritten")))
+	if view, _ := r.Get("k9"); w.Code != http.StatusForbidden || view.String() != "nine" {
+		t.Fatalf("PUT by a non-admin returned %d, then Get = %v", w.Code, view)
+	}
+	w = httptest.NewRecorder()
+	pool.ServeHTTP(w, signedRequest(t, http.MethodGet, defaultBasePath+"_admin/snapshot/Introspect%2F1", "admin", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), snapshotMagic) {
+		t.Fatalf("snapshot returned %d: %.20q", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	pool.ServeHTTP(w, signedRequest(t, http.MethodGet, defaultBasePath+"_admin/snapshot/Introspect%2Fprivate", "admin", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("snapshot of a relation admin may not read returned %d", w.Code)
+	}
+
+	admin(http.MethodGet, "relations/NoSuchRelation", http.StatusNotFound, nil)
+	admin(http.MethodPost, "relations/Introspect%2F1/keys/k1", http.StatusMethodNotAllowed, nil)
+	admin(http.MethodPost, "ring", http.StatusMethodNotAllowed, nil)
+	admin(http.MethodGet, "owner/", http.StatusBadRequest, nil)
+}
+
+func Test_LoadLease(t *testing.T) {
+	var loads int32
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte("value"), nil
+	})
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	srvA := httptest.NewServer(http.NotFoundHandler())
+	defer srvA.Close()
+	srvB := httptest.NewServer(http.NotFoundHandler())
+	defer srvB.Close()
+
+	var rels []*Relation
+	for _, srv := range []*httptest.Server{srvA, srvB} {
+		pool := NewHTTPPool(srv.URL, WithLoadLeases(time.Second))
+		pool.Set(srvA.URL, srvB.URL, dead.URL)
+		srv.Config.Handler = pool
+		r := NewRelation("Lease", 0, getter)
+		r.RegisterPeers(pool)
+		rels = append(rels, r)
+	}
+
+	// find a key owned by the dead peer and coordinated by A.
+	ring := consistenthash.New(defaultReplicas, nil)
+	ring.Add(srvA.URL, srvB.URL, dead.URL)
+	key := ""
+	for i := 0; key == ""; i++ {
+		k := strconv.Itoa(i)
+		if nodes := ring.GetN(k, 2); nodes[0] == dead.URL && nodes[1] == srvA.URL {
+			key = k
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range rels {
+		wg.Add(1)
+		go func(r *Relation) {
+			defer wg.Done()
+			if view, err := r.Get(key); err != nil || view.String() != "value" {
+				t.Errorf("Get(%s) = %v, %v", key, view, err)
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("expect a single load cluster-wide, got %d", loads)
+	}
+	// the node that waited cached the value too.
+	for _, r := range rels {
+		if view, err := r.Get(key); err != nil || view.String() != "value" {
+			t.Fatalf("Get(%s) again = %v, %v", key, view, err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("expect later Gets to be served from cache, got %d loads", loads)
+	}
+}
+
+// pickPeer is a PeerPicker that always picks the same peer.
+type pickPeer struct {
+	peer PeerGetter
+}
+
+func (p pickPeer) PickPeer(key string) (PeerGetter, bool) {
+	return p.peer, true
+}
+
+// valuePeer is a PeerGetter and Leaser that returns the same response to
+// every request, or fails Get with err.
+type valuePeer struct {
+	res *pb.Response
+	err error
+}
+
+func (p valuePeer) Get(in *pb.Request, out *pb.Response) error {
+	if p.err != nil {
+		return p.err
+	}
+	out.Value, out.Encoding = p.res.Value, p.res.Encoding
+	return nil
+}
+
+func (p valuePeer) Acquire(in *pb.Request) (*Lease, error) {
+	return &Lease{Value: p.res.Value}, nil
+}
+
+func (p valuePeer) Release(in *pb.Request, token string, value []byte) error {
+	return nil
+}
+
+func (p valuePeer) PickPeer(key string) (PeerGetter, bool) {
+	return p, true
+}
+
+func (p valuePeer) PickLeaser(key string) (Leaser, bool) {
+	return p, true
+}
+
+func Test_PeerValueSize(t *testing.T) {
+	large := make([]byte, 1<<20)
+	compressed, err := GzipCompressor{}.Compress(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return nil, fmt.Errorf("must not load %s", key)
+	})
+	peers := []valuePeer{
+		{res: &pb.Response{Value: compressed, Encoding: "gzip"}},
+		{res: &pb.Response{Value: large}, err: errors.New("owner is down")},
+	}
+	for i, peer := range peers {
+		r := NewRelation(fmt.Sprintf("PeerValueSize/%d", i), 0, getter, WithMaxValueSize(64<<10))
+		r.RegisterPeers(peer)
+		if _, err := r.Get("key"); !errors.Is(err, ErrValueTooLarge) {
+			t.Fatalf("peer %d: Get = %v, want ErrValueTooLarge", i, err)
+		}
+	}
+
+	// an HTTP peer's response is refused before it is read in full: this
+	// one doesn't end before the client hangs up.
+	body, err := proto.Marshal(&pb.Response{Value: large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	r := NewRelation("PeerValueSize/http", 0, getter, WithMaxValueSize(64<<10))
+	r.RegisterPeers(pickPeer{&httpGetter{baseURL: srv.URL + defaultBasePath}})
+	start := time.Now()
+	if _, err := r.Get("key"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("HTTP peer: Get = %v, want ErrValueTooLarge", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("HTTP peer: Get took %v, want it to stop reading at the limit", d)
+	}
+}
+
+func Test_PeerDeadlines(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPPool("http://server"))
+	defer srv.Close()
+
+	// the client is created first, so the registry serves the server
+	// relation of the same name.
+	client := NewRelation("PeerDeadlines", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("client must not load %s", key)
+		},
+	))
+	client.RegisterPeers(pickPeer{&httpGetter{baseURL: srv.URL + defaultBasePath}})
+	NewRelation("PeerDeadlines", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("value"), nil
+		},
+	), WithExpiry(time.Minute, time.Hour))
+
+	view, err := client.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age, ok := maxAge(view, time.Now()); !ok || age < 59 || age > 60 || view.expire.IsZero() {
+		t.Fatalf("peer value has deadlines %v, %v", view.stale, view.expire)
+	}
+}
+
+func Test_GetReader(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPPool("http://server"))
+	defer srv.Close()
+	peer := pickPeer{&httpGetter{baseURL: srv.URL + defaultBasePath}}
+
+	// the clients are created first, so the registry serves the server
+	// relation of the same name.
+	client := NewRelation("Stream", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, fmt.Errorf("client must not load %s", key)
+		},
+	))
+	client.RegisterPeers(peer)
+	limited := NewRelation("Stream", 0, client.getter, WithMaxValueSize(1<<10))
+	limited.RegisterPeers(peer)
+
+	value := bytes.Repeat([]byte("0123456789"), 3*streamChunkSize/10+7)
+	NewRelation("Stream", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return value, nil
+		},
+	))
+
+	rc, err := client.GetReader("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, ok := rc.(*chunkReader); !ok {
+		t.Fatalf("value was not streamed, got %T", rc)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("streamed %d bytes, %v; want %d bytes", len(got), err, len(value))
+	}
+
+	if _, err := limited.GetReader("blob"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("GetReader over the limit = %v; want ErrValueTooLarge", err)
+	}
+	if _, err := limited.Get("blob"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Get over the limit = %v; want ErrValueTooLarge", err)
+	}
+}
+
+func Test_Rebalance(t *testing.T) {
+	// the new owner only records what it is handed, and refuses the first
+	// entry of every batch.
+	var mu sync.Mutex
+	received := make(map[string]string)
+	refused := make(map[string]bool)
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		br := bufio.NewReader(req.Body)
+		for i := 0; ; i++ {
+			entry := &pb.Entry{}
+			if err := protodelim.UnmarshalFrom(br, entry); err != nil {
+				break
+			}
+			mu.Lock()
+			if i == 0 {
+				refused[entry.GetKey()] = true
+			} else {
+				received[entry.GetKey()] = string(entry.GetValue())
+			}
+			mu.Unlock()
+		}
+		body, _ := proto.Marshal(&pb.TransferResponse{Refused: []uint32{0}})
+		w.Write(body)
+	}))
+	defer owner.Close()
+
+	p := NewHTTPPool("http://self", WithRebalancing(0))
+	p.Set("http://self")
+	r := NewRelation("Rebalance", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("value of " + key), nil
+		},
+	))
+	r.RegisterPeers(p)
+	for i := 0; i < 50; i++ {
+		if _, err := r.Get(fmt.Sprintf("k%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p.Set("http://self", owner.URL)
+	deadline := time.Now().Add(5 * time.Second)
+	for s := p.RebalanceStats(); s.Moved+s.Failed == 0 || s.Pending != 0; s = p.RebalanceStats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("handoff did not finish: %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ring := consistenthash.New(defaultReplicas, nil)
+	ring.Add("http://self", owner.URL)
+	moved := 0
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		_, cached := r.cache.get(key)
+		value, handed := received[key]
+		if mine := ring.Get(key) == "http://self" || refused[key]; cached != mine || handed == mine {
+			t.Fatalf("%s: cached %v, handed off %v", key, cached, handed)
+		}
+		if handed {
+			moved++
+			if value != "value of "+key {
+				t.Fatalf("%s handed off as %q", key, value)
+			}
+		}
+	}
+	if s := p.RebalanceStats(); s.Moved != int64(moved) || s.Rebalances != 1 || s.Failed != int64(len(refused)) || len(refused) != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func Test_ServeTransfer(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return nil, fmt.Errorf("%s must be handed off, not loaded", key)
+	})
+	keys := map[string][]byte{"http://other": []byte("other secret"), "admin": testKeys["admin"]}
+	p := NewHTTPPool("http://self", WithRebalancing(0), WithAuth(HMACAuth{Keys: keys}))
+	p.Set("http://self", "http://other")
+	r := NewRelation("Transfer", 0, getter, WithMaxValueSize(1<<10))
+	r.RegisterPeers(p)
+	private := NewRelation("Transfer/private", 0, getter, WithReaders("peer"))
+	private.RegisterPeers(p)
+	unserved := NewRelation("Transfer/unserved", 0, getter)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// owned[true] is owned by this node, owned[false] by the other.
+	owned := make(map[bool]string)
+	for i := 0; len(owned) < 2; i++ {
+		key := fmt.Sprintf("k%d", i)
+		owned[p.peers.Get(key) == "http://self"] = key
+	}
+	post := func(id string, body io.Reader) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+defaultBasePath+transferPrefix, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "" {
+			if err := (HMACAuth{Secret: keys[id], ID: id}).Sign(req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	bomb, err := GzipCompressor{}.Compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	for _, entry := range []*pb.Entry{
+		{Relation: "Transfer", Key: owned[true], Value: []byte("v"), Expire: time.Now().Add(time.Hour).UnixNano()},
+		{Relation: "Transfer", Key: "expired", Value: []byte("v"), Expire: time.Now().Add(-time.Hour).UnixNano()},
+		{Relation: "Transfer", Key: owned[false], Value: []byte("v")},
+		{Relation: "Transfer", Key: "large", Value: make([]byte, 2<<10)},
+		{Relation: "Transfer", Key: "bomb", Value: bomb, Encoding: "gzip"},
+		{Relation: "Transfer/private", Key: owned[true], Value: []byte("v")},
+		{Relation: "Transfer/unserved", Key: owned[true], Value: []byte("v")},
+		{Relation: "NoSuchRelation", Key: "k", Value: []byte("v")},
+	} {
+		protodelim.MarshalTo(&body, entry)
+	}
+	batch := body.Bytes()
+	// only peers may hand entries off.
+	for id, want := range map[string]int{"": http.StatusUnauthorized, "admin": http.StatusForbidden} {
+		res := post(id, bytes.NewReader(batch))
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Fatalf("transfer from %q returned %s", id, res.Status)
+		}
+	}
+	if n := r.CacheStats().Items; n != 0 {
+		t.Fatalf("refused transfers cached %d entries", n)
+	}
+
+	res := post("http://other", bytes.NewReader(batch))
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	var answer pb.TransferResponse
+	if err != nil || res.StatusCode != http.StatusOK || proto.Unmarshal(b, &answer) != nil {
+		t.Fatalf("transfer returned %s: %q, %v", res.Status, b, err)
+	}
+	if want := []uint32{1, 2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(answer.GetRefused(), want) {
+		t.Fatalf("refused entries %v, want %v", answer.GetRefused(), want)
+	}
+
+	if view, ok := r.cache.get(owned[true]); !ok || view.String() != "v" {
+		t.Fatalf("handed off entry not cached: %q", view.String())
+	}
+	for rel, want := range map[*Relation]int64{r: 1, private: 0, unserved: 0} {
+		if items := rel.CacheStats().Items; items != want {
+			t.Fatalf("%s cached %d entries, want %d", rel.name, items, want)
+		}
+	}
+	if s := p.RebalanceStats(); s.Received != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// a message larger than any relation accepts is refused as a whole.
+	body.Reset()
+	protodelim.MarshalTo(&body, &pb.Entry{Relation: "Transfer", Key: owned[true], Value: make([]byte, maxTransferValue+transferEntryOverhead)})
+	res = post("http://other", &body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("oversized transfer returned %s", res.Status)
+	}
+}
+
+func Test_ServeHTTPValidation(t *testing.T) {
+	NewRelation("Strict", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		},
+	))
+	p := NewHTTPPool("http://self")
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/elsewhere/Strict/key", http.StatusNotFound},
+		{http.MethodGet, "/_ocache/Strict/key", http.StatusOK},
+		{http.MethodHead, "/_ocache/Strict/key", http.StatusOK},
+		{http.MethodPost, "/_ocache/Strict/key", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/_ocache/Strict/key", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/_ocache/Strict", http.StatusBadRequest},
+		{http.MethodGet, "/_ocache/Strict/", http.StatusBadRequest},
+		{http.MethodGet, "/_ocache//key", http.StatusBadRequest},
+		{http.MethodGet, "/_ocache/Strict/" + strings.Repeat("k", MaxKeyLength+1), http.StatusBadRequest},
+		{http.MethodGet, "/_ocache/NoSuchRelation/key", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Fatalf("%s %.40s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func FuzzKeyRoundTrip(f *testing.F) {
+	for _, key := range []string{"key", "a b", "a+b", "a/b", "%2F", "50%", "?q=1#f", "é", "\x00\xff", "/"} {
+		f.Add(key)
+	}
+	NewRelation("Fuzz +/%", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		},
+	))
+	srv := httptest.NewServer(NewHTTPPool("http://server"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+
+	f.Fuzz(func(t *testing.T, key string) {
+		res := &pb.Response{}
+		err := peer.Get(&pb.Request{Relation: "Fuzz +/%", Key: key}, res)
+		if key == "" || len(key) > MaxKeyLength {
+			if err == nil {
+				t.Fatalf("key of %d bytes was served", len(key))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		if string(res.Value) != key {
+			t.Fatalf("Get(%q) served key %q", key, res.Value)
+		}
+	})
+}
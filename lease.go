@@ -0,0 +1,284 @@
+package ocache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// leasePrefix is the path, below the pool's base path, of the lease
+// endpoints. It shadows any relation named "_lease".
+const leasePrefix = "_lease/"
+
+// leaseTokenHeader carries the token of a granted lease.
+const leaseTokenHeader = "X-Ocache-Lease"
+
+// A leaseTable grants the leases of the keys a node coordinates.
+type leaseTable struct {
+	timeout time.Duration
+	mu      sync.Mutex // guards leases and closed
+	leases  map[string]*lease
+	closed  bool
+}
+
+type lease struct {
+	token string
+	done  chan struct{} // closed on release or expiry
+	value []byte        // nil unless the holder loaded it
+	timer *time.Timer
+}
+
+func newLeaseTable(timeout time.Duration) *leaseTable {
+	return &leaseTable{
+		timeout: timeout,
+		leases:  make(map[string]*lease),
+	}
+}
+
+func leaseKey(in *pb.Request) string {
+	return in.GetRelation() + "/" + in.GetKey()
+}
+
+// acquire grants the lease on in, or waits for its holder. A holder that
+// doesn't release the lease within timeout loses it.
+func (t *leaseTable) acquire(in *pb.Request) (*Lease, error) {
+	k := leaseKey(in)
+	deadline := time.Now().Add(t.timeout)
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return nil, fmt.Errorf("not granting leases, shutting down")
+		}
+		l, held := t.leases[k]
+		if !held {
+			l = &lease{token: newLeaseToken(), done: make(chan struct{})}
+			t.leases[k] = l
+			l.timer = time.AfterFunc(t.timeout, func() {
+				_ = t.release(in, l.token, nil)
+			})
+			t.mu.Unlock()
+			return &Lease{Granted: true, Token: l.token}, nil
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-l.done:
+			if l.value != nil {
+				return &Lease{Value: l.value}, nil
+			}
+			// the holder failed, compete for the lease again.
+		case <-time.After(time.Until(deadline)):
+			return nil, fmt.Errorf("timed out waiting for lease on %s", k)
+		}
+	}
+}
+
+func (t *leaseTable) release(in *pb.Request, token string, value []byte) error {
+	k := leaseKey(in)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.leases[k]
+	if !ok || l.token != token {
+		return fmt.Errorf("no lease %s on %s", token, k)
+	}
+	delete(t.leases, k)
+	l.timer.Stop()
+	l.value = value
+	close(l.done)
+	return nil
+}
+
+// close fails every lease and stops their timers. Holders can no longer
+// release them, and no lease is granted after.
+func (t *leaseTable) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for k, l := range t.leases {
+		delete(t.leases, k)
+		l.timer.Stop()
+		close(l.done)
+	}
+}
+
+func newLeaseToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// localLeaser is the Leaser for keys this node coordinates itself.
+type localLeaser struct {
+	table *leaseTable
+}
+
+func (l localLeaser) Acquire(in *pb.Request) (*Lease, error) {
+	return l.table.acquire(in)
+}
+
+func (l localLeaser) Release(in *pb.Request, token string, value []byte) error {
+	return l.table.release(in, token, value)
+}
+
+var _ Leaser = localLeaser{}
+
+func (h *httpGetter) leaseURL(in *pb.Request) string {
+	return keyURL(h.baseURL+leasePrefix, in)
+}
+
+// Acquire implements Leaser with POST <base path>_lease/<relation>/<key>.
+func (h *httpGetter) Acquire(in *pb.Request) (*Lease, error) {
+	req, err := http.NewRequest(http.MethodPost, h.leaseURL(in), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := do(h.client, h.auth, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return &Lease{Granted: true, Token: res.Header.Get(leaseTokenHeader)}, nil
+	case http.StatusOK:
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading response body: %v", err)
+		}
+		out := &pb.Response{}
+		if err = proto.Unmarshal(body, out); err != nil {
+			return nil, fmt.Errorf("decoding response body: %v", err)
+		}
+		return &Lease{Value: cloneBytes(out.GetValue())}, nil
+	default:
+		return nil, fmt.Errorf("server returned: %v", res.Status)
+	}
+}
+
+// Release implements Leaser with PUT (value loaded) or DELETE (load
+// failed) <base path>_lease/<relation>/<key>?token=<token>.
+func (h *httpGetter) Release(in *pb.Request, token string, value []byte) error {
+	u := h.leaseURL(in) + "?token=" + url.QueryEscape(token)
+	method, body := http.MethodDelete, []byte(nil)
+	if value != nil {
+		var err error
+		if body, err = proto.Marshal(&pb.Response{Value: value}); err != nil {
+			return err
+		}
+		method = http.MethodPut
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err := do(h.client, h.auth, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+var _ Leaser = (*httpGetter)(nil)
+
+// PickLeaser picks the node that coordinates loads of key while its owner
+// is unreachable: the next distinct node after the owner on the ring.
+func (p *HTTPPool) PickLeaser(key string) (Leaser, bool) {
+	if p.leases == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return nil, false
+	}
+	nodes := p.peers.GetN(key, 2)
+	if len(nodes) < 2 {
+		return nil, false
+	}
+	if nodes[1] == p.host {
+		return localLeaser{p.leases}, true
+	}
+	return p.httpGetters[nodes[1]], true
+}
+
+var _ LeasePicker = (*HTTPPool)(nil)
+
+// serveLease handles requests for /<base path>/_lease/<relation>/<key>.
+func (p *HTTPPool) serveLease(w http.ResponseWriter, request *http.Request, identity, path string) {
+	if p.leases == nil {
+		http.Error(w, "Load leases disabled", http.StatusNotFound)
+		return
+	}
+	relation, key, err := parseKeyPath(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r := GetRelation(relation); r != nil && !p.authorize(w, r, identity) {
+		return
+	}
+	in := &pb.Request{Relation: relation, Key: key}
+	token := request.URL.Query().Get("token")
+
+	switch request.Method {
+	case http.MethodPost:
+		l, err := p.leases.acquire(in)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if l.Granted {
+			w.Header().Set(leaseTokenHeader, l.Token)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		body, err := proto.Marshal(&pb.Response{Value: l.Value})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(body)
+	case http.MethodPut:
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out := &pb.Response{}
+		if err = proto.Unmarshal(body, out); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.finishLease(w, in, token, cloneBytes(out.GetValue()))
+	case http.MethodDelete:
+		p.finishLease(w, in, token, nil)
+	default:
+		w.Header().Set("Allow", "POST, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *HTTPPool) finishLease(w http.ResponseWriter, in *pb.Request, token string, value []byte) {
+	if err := p.leases.release(in, token, value); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -10,11 +10,27 @@ type Cache struct {
 	eles map[string]*list.Element
 	// optional and executed when an entry is purged.
 	OnEvicted func(key string, value Value)
+	// optional and executed when an entry is too big to be added.
+	OnRejected func(key string, value Value)
+	// MaxEntryFraction is the largest share of cap a single entry may
+	// take, in (0, 1]. Zero means 1, i.e. anything that fits in cap.
+	MaxEntryFraction float64
+	// EntryOverhead is added to the accounted size of every entry, so
+	// that cap bounds real memory rather than just payload bytes.
+	// See DefaultEntryOverhead.
+	EntryOverhead int64
+	rejections    int64
 }
 
+// DefaultEntryOverhead approximates, on 64-bit platforms, what an entry
+// costs beyond len(key)+val.Len(): a list.Element (48 bytes), the entry
+// itself (48), its map slot (~24) and a boxed slice-backed Value (24).
+const DefaultEntryOverhead = 144
+
 type entry struct {
-	key string
-	val Value
+	key  string
+	val  Value
+	size int64 // accounted size, fixed when the entry is stored
 }
 
 // Value use Len to count how many size it takes.
@@ -46,34 +62,109 @@ func (c *Cache) Get(key string) (val Value, ok bool) {
 func (c *Cache) Eviction() {
 	ele := c.ll.Front()
 	if ele != nil {
-		c.ll.Remove(ele)
-		kv := ele.Value.(*entry)
-		delete(c.eles, kv.key)
-		c.size -= int64(len(kv.key)) + int64(kv.val.Len())
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.val)
-		}
+		c.removeElement(ele)
 	}
 }
 
-// Add adds a val to the eles.
-func (c *Cache) Add(key string, val Value) {
+// Remove removes the provided key from the cache.
+func (c *Cache) Remove(key string) {
+	if ele, ok := c.eles[key]; ok {
+		c.removeElement(ele)
+	}
+}
+
+func (c *Cache) removeElement(ele *list.Element) {
+	c.ll.Remove(ele)
+	kv := ele.Value.(*entry)
+	delete(c.eles, kv.key)
+	c.size -= kv.size
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.val)
+	}
+}
+
+// Add adds a val to the eles. An entry bigger than MaxEntryFraction of cap
+// is rejected: it is reported through OnRejected and any previous value
+// stored under key is removed, so the cache never holds a stale value.
+// It reports whether the entry was stored.
+func (c *Cache) Add(key string, val Value) bool {
+	size := c.entrySize(key, val)
+	if c.oversized(size) {
+		c.Remove(key)
+		c.rejections++
+		if c.OnRejected != nil {
+			c.OnRejected(key, val)
+		}
+		return false
+	}
 	if e, ok := c.eles[key]; ok {
 		c.ll.MoveToBack(e)
 		kv := e.Value.(*entry)
-		c.size += int64(val.Len()) - int64(kv.val.Len())
+		c.size += size - kv.size
 		kv.val = val
+		kv.size = size
 	} else {
-		ele := c.ll.PushBack(&entry{key, val})
+		ele := c.ll.PushBack(&entry{key, val, size})
 		c.eles[key] = ele
-		c.size += int64(len(key)) + int64(val.Len())
+		c.size += size
+	}
+	for c.cap != 0 && c.cap < c.size {
+		c.Eviction()
+	}
+	return true
+}
+
+func (c *Cache) oversized(size int64) bool {
+	if c.cap == 0 {
+		return false
+	}
+	limit := c.cap
+	if f := c.MaxEntryFraction; f > 0 && f < 1 {
+		limit = int64(float64(c.cap) * f)
+	}
+	return size > limit
+}
+
+func (c *Cache) entrySize(key string, val Value) int64 {
+	return int64(len(key)) + int64(val.Len()) + c.EntryOverhead
+}
+
+// Range calls f for every entry from the least to the most recently
+// used, until f returns false. It does not change the order of entries.
+func (c *Cache) Range(f func(key string, val Value) bool) {
+	for ele := c.ll.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		if !f(kv.key, kv.val) {
+			return
+		}
 	}
+}
+
+// SetCap changes the capacity, evicting the oldest entries until the cache
+// fits. cap = 0 means no limit.
+func (c *Cache) SetCap(cap int64) {
+	c.cap = cap
 	for c.cap != 0 && c.cap < c.size {
 		c.Eviction()
 	}
 }
 
+// Cap the capacity of the cache.
+func (c *Cache) Cap() int64 {
+	return c.cap
+}
+
 // Len the number of eles entries.
 func (c *Cache) Len() int {
 	return c.ll.Len()
 }
+
+// Size the number of bytes accounted to live entries.
+func (c *Cache) Size() int64 {
+	return c.size
+}
+
+// Rejections the number of entries refused by Add for being too big.
+func (c *Cache) Rejections() int64 {
+	return c.rejections
+}
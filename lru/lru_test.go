@@ -1,8 +1,12 @@
 package lru
 
 import (
+	"fmt"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
 type String string
@@ -53,3 +57,135 @@ func Test_OnEvicted(t *testing.T) {
 		t.Fatalf("Call OnEvicted failed, expect keys equals to %s", expect)
 	}
 }
+
+func Test_Rejected(t *testing.T) {
+	rejected := make([]string, 0)
+	lru := New(int64(20), nil)
+	lru.MaxEntryFraction = 0.5
+	lru.OnRejected = func(key string, value Value) {
+		rejected = append(rejected, key)
+	}
+	lru.Add("k1", String("v1"))
+	lru.Add("k2", String("v2"))
+	if lru.Add("big", String("0123456789")) {
+		t.Fatalf("entry over MaxEntryFraction should be rejected")
+	}
+	if lru.Len() != 2 || lru.Size() != 8 {
+		t.Fatalf("rejected entry must not evict others, len=%d size=%d", lru.Len(), lru.Size())
+	}
+
+	// growing an existing entry past the limit drops the stale value.
+	lru.Add("k1", String("0123456789"))
+	if _, ok := lru.Get("k1"); ok {
+		t.Fatalf("stale k1 kept after oversized update")
+	}
+	expect := []string{"big", "k1"}
+	if !reflect.DeepEqual(expect, rejected) || lru.Rejections() != 2 {
+		t.Fatalf("Call OnRejected failed, expect keys equals to %s, got %s", expect, rejected)
+	}
+}
+
+type op struct {
+	Key    uint8
+	Len    uint8
+	Remove bool
+}
+
+// checkInvariants verifies that size is the sum of the live entries and
+// stays within cap.
+func checkInvariants(c *Cache) bool {
+	var sum int64
+	for ele := c.ll.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		if kv.size != c.entrySize(kv.key, kv.val) || c.eles[kv.key] != ele {
+			return false
+		}
+		sum += kv.size
+	}
+	return sum == c.size && len(c.eles) == c.ll.Len() &&
+		(c.cap == 0 || c.size <= c.cap)
+}
+
+func Test_SizeInvariant(t *testing.T) {
+	f := func(cap uint8, fraction uint8, overhead uint8, ops []op) bool {
+		lru := New(int64(cap), nil)
+		lru.MaxEntryFraction = float64(fraction) / 255
+		lru.EntryOverhead = int64(overhead % 16)
+		for _, o := range ops {
+			key := string(rune('a' + o.Key%8))
+			if o.Remove {
+				lru.Remove(key)
+			} else {
+				lru.Add(key, String(strings.Repeat("x", int(o.Len))))
+			}
+			if !checkInvariants(lru) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type bytesValue []byte
+
+func (b bytesValue) Len() int {
+	return len(b)
+}
+
+func Test_EntryOverhead(t *testing.T) {
+	const n = 100000
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	lru := New(int64(0), nil)
+	lru.EntryOverhead = DefaultEntryOverhead
+	for i := 0; i < n; i++ {
+		lru.Add(fmt.Sprintf("key%05d", i), bytesValue(make([]byte, 8)))
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(lru)
+
+	heap := float64(after.HeapAlloc - before.HeapAlloc)
+	if ratio := float64(lru.Size()) / heap; ratio < 0.75 || ratio > 1.25 {
+		t.Fatalf("accounted %d bytes but heap grew by %.0f (ratio %.2f)", lru.Size(), heap, ratio)
+	}
+}
+
+func Test_SetCap(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("k1", String("v1"))
+	lru.Add("k2", String("v2"))
+	lru.Add("k3", String("v3"))
+	lru.SetCap(8)
+	if _, ok := lru.Get("k1"); ok || lru.Len() != 2 || lru.Size() != 8 {
+		t.Fatalf("shrink to 8 failed")
+	}
+	lru.SetCap(12)
+	lru.Add("k4", String("v4"))
+	if lru.Len() != 3 || lru.Cap() != 12 {
+		t.Fatalf("grow to 12 failed")
+	}
+}
+
+func Test_Range(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("k1", String("v1"))
+	lru.Add("k2", String("v2"))
+	lru.Add("k3", String("v3"))
+	lru.Get("k1")
+
+	keys := make([]string, 0)
+	lru.Range(func(key string, val Value) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	if !reflect.DeepEqual(keys, []string{"k2", "k3"}) {
+		t.Fatalf("Range visited %s, want oldest first", keys)
+	}
+}
@@ -0,0 +1,112 @@
+package ocache
+
+import "sync"
+
+// A MemoryPool is a memory budget shared by every relation that joins it
+// with WithMemoryPool. Whenever the members together use more than the
+// limit, entries are evicted from the member using the most memory
+// relative to its priority, so a relation with priority 2 is allowed
+// twice the share of one with priority 1 before it loses entries.
+type MemoryPool struct {
+	limit   int64
+	mu      sync.Mutex // guards members and serializes eviction
+	members []poolMember
+}
+
+type poolMember struct {
+	cache    *Cache
+	priority float64
+}
+
+// NewMemoryPool creates a MemoryPool of limit bytes.
+func NewMemoryPool(limit int64) *MemoryPool {
+	if limit <= 0 {
+		panic("ocache: memory pool limit must be positive")
+	}
+	return &MemoryPool{limit: limit}
+}
+
+// WithMemoryPool makes the relation draw from pool in addition to its own
+// cacheBytes, which may then be 0 to rely on the pool alone. Priorities
+// below or equal to 0 are treated as 1.
+func WithMemoryPool(pool *MemoryPool, priority float64) RelationOption {
+	if priority <= 0 {
+		priority = 1
+	}
+	return func(r *Relation) {
+		r.cache.pool = pool
+		pool.join(&r.cache, priority)
+	}
+}
+
+// Limit returns the pool's budget in bytes.
+func (p *MemoryPool) Limit() int64 {
+	return p.limit
+}
+
+// Size returns the bytes currently used by all members.
+func (p *MemoryPool) Size() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var total int64
+	for _, m := range p.members {
+		total += m.cache.bytes()
+	}
+	return total
+}
+
+func (p *MemoryPool) join(c *Cache, priority float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.members = append(p.members, poolMember{cache: c, priority: priority})
+}
+
+// leave removes c from the members.
+func (p *MemoryPool) leave(c *Cache) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, m := range p.members {
+		if m.cache == c {
+			p.members = append(p.members[:i:i], p.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// enforce evicts entries until the members fit in the limit again.
+// It must not be called with any member's lock held.
+func (p *MemoryPool) enforce() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sizes := make([]int64, len(p.members))
+	var total int64
+	for i, m := range p.members {
+		sizes[i] = m.cache.bytes()
+		total += sizes[i]
+	}
+
+	for total > p.limit {
+		victim := -1
+		var worst float64
+		for i, m := range p.members {
+			if sizes[i] == 0 {
+				continue
+			}
+			if w := float64(sizes[i]) / m.priority; victim < 0 || w > worst {
+				victim, worst = i, w
+			}
+		}
+		if victim < 0 {
+			return
+		}
+		freed := p.members[victim].cache.evictOldest()
+		if freed == 0 {
+			// nothing left to evict in this member.
+			sizes[victim] = 0
+			continue
+		}
+		sizes[victim] -= freed
+		total -= freed
+	}
+}
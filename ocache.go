@@ -1,13 +1,20 @@
 package ocache
 
 import (
+	"errors"
 	"fmt"
+	"github.com/nohsueh/ocache/disk"
 	pb "github.com/nohsueh/ocache/ocachepb"
 	"github.com/nohsueh/ocache/singleflight"
 	"log"
 	"sync"
+	"time"
 )
 
+// ErrNotFound may be returned, or wrapped, by Getters for keys that have
+// no value, which APIHandler reports as 404 Not Found.
+var ErrNotFound = errors.New("ocache: not found")
+
 // A Getter loads data for a key.
 type Getter interface {
 	Get(key string) ([]byte, error)
@@ -30,6 +37,22 @@ type Relation struct {
 	// use singleflight.Relation to make sure that
 	// each key is only fetched once
 	loader *singleflight.Relation
+
+	// see WithExpiry and WithRefreshAhead.
+	softTTL, hardTTL, refreshAhead time.Duration
+	refreshMu                      sync.Mutex // guards refreshing
+	refreshing                     map[string]struct{}
+	// see WithMaxValueSize.
+	maxValueSize int64
+	// see WithCompression.
+	compressor Compressor
+	// see WithReaders, nil if anyone may read.
+	readers map[string]bool
+	// see WithSnapshot.
+	snapshotPath     string
+	snapshotInterval time.Duration
+	stopSnapshots    chan struct{}
+	closeOnce        sync.Once
 }
 
 var (
@@ -37,10 +60,49 @@ var (
 	relations = make(map[string]*Relation)
 )
 
+// A RelationOption configures a Relation created by NewRelation.
+type RelationOption func(*Relation)
+
+// WithArena stores the relation's entries in an arena.Cache, a single
+// preallocated buffer the GC never scans, instead of an lru.Cache.
+// Eviction becomes FIFO rather than LRU. It requires a positive cacheBytes.
+func WithArena() RelationOption {
+	return func(r *Relation) {
+		r.cache.arena = true
+	}
+}
+
+// WithMaxEntryFraction rejects values larger than fraction of cacheBytes
+// instead of letting a single entry flush the whole cache. Rejections are
+// counted in CacheStats. It has no effect on WithArena relations, which
+// only reject entries that cannot fit at all.
+func WithMaxEntryFraction(fraction float64) RelationOption {
+	return func(r *Relation) {
+		r.cache.maxEntryFraction = fraction
+	}
+}
+
+// WithEntryOverhead accounts bytes of bookkeeping to every entry on top of
+// its key and value, so that cacheBytes bounds the memory the cache really
+// uses. lru.DefaultEntryOverhead is a good estimate. WithArena relations
+// already account their fixed per-entry header and ignore it.
+func WithEntryOverhead(bytes int64) RelationOption {
+	return func(r *Relation) {
+		r.cache.entryOverhead = bytes
+	}
+}
+
+// WithDiskStore adds store as a second cache level: entries evicted from
+// memory are moved to it, and misses look there before loading from peers
+// or the Getter. A store must not be shared between relations.
+func WithDiskStore(store *disk.Store) RelationOption {
+	return func(r *Relation) {
+		r.cache.l2 = store
+	}
+}
+
 // NewRelation create a new instance of Relation.
-func NewRelation(name string, cacheBytes int64, getter Getter) *Relation {
-	mu.Lock()
-	defer mu.Unlock()
+func NewRelation(name string, cacheBytes int64, getter Getter, opts ...RelationOption) *Relation {
 	if getter == nil {
 		panic("nil Getter")
 	}
@@ -50,6 +112,16 @@ func NewRelation(name string, cacheBytes int64, getter Getter) *Relation {
 		cache:  Cache{cap: cacheBytes},
 		loader: &singleflight.Relation{},
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.snapshotPath != "" {
+		// loading may take a while, don't hold mu meanwhile. The relation
+		// isn't registered yet, so nothing reads it before it is loaded.
+		r.startSnapshots()
+	}
+	mu.Lock()
+	defer mu.Unlock()
 	relations[name] = r
 	return r
 }
@@ -65,18 +137,108 @@ func GetRelation(name string) *Relation {
 
 // Get bytes for a key from Cache.
 func (r *Relation) Get(key string) (ByteView, error) {
+	view, err := r.get(key)
+	if err != nil {
+		return ByteView{}, err
+	}
+	return decode(view, r.maxValueSize)
+}
+
+// get is Get without decoding compressed views.
+func (r *Relation) get(key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
 
 	if view, ok := r.cache.get(key); ok {
 		log.Println("[Cache] hit")
+		if r.needsRefresh(view, time.Now()) {
+			r.refresh(key)
+		}
 		return view, nil
 	}
 
 	return r.load(key)
 }
 
+// Set caches value for key on this node, as if the Getter had loaded it.
+// Copies cached by other peers are not affected.
+func (r *Relation) Set(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if err := r.checkSize(int64(len(value))); err != nil {
+		return err
+	}
+	view := ByteView{bytes: cloneBytes(value)}
+	r.stamp(&view, time.Now())
+	r.populateCache(key, r.encode(view))
+	return nil
+}
+
+// Remove drops key from this node's cache, so the next Get loads it again.
+// Copies cached by other peers are not affected.
+func (r *Relation) Remove(key string) {
+	r.cache.remove(key)
+}
+
+// Purge drops every entry from this node's cache, including its
+// WithDiskStore tier, and returns the number of entries dropped from memory.
+func (r *Relation) Purge() int64 {
+	return r.cache.purge()
+}
+
+// GetInto fills dest with the value for a key, copying only as much as
+// the kind of Sink requires. It is the Sink-filling form of Get, which
+// keeps returning a ByteView for the callers that hold on to it.
+func (r *Relation) GetInto(key string, dest Sink) error {
+	view, err := r.Get(key)
+	if err != nil {
+		return err
+	}
+	return setSinkView(dest, view)
+}
+
+// CacheStats returns stats about the relation's cache.
+func (r *Relation) CacheStats() CacheStats {
+	return r.cache.stats()
+}
+
+// SetCapacity changes the relation's cacheBytes while it is serving.
+// Shrinking evicts the oldest entries right away. A WithArena relation
+// needs at least arena.MinCap bytes, and moves its entries to the arena if
+// it had no limit so far.
+func (r *Relation) SetCapacity(bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("capacity must not be negative")
+	}
+	return r.cache.setCap(bytes)
+}
+
+// Capacity returns the relation's current cacheBytes.
+func (r *Relation) Capacity() int64 {
+	return r.cache.capacity()
+}
+
+// Close stops the relation's background work. With WithSnapshot, it
+// saves a last snapshot. With WithMemoryPool, it leaves the pool and drops
+// its entries in memory, those of a WithDiskStore are kept. The relation
+// keeps serving Get, though a relation that left its pool stores nothing
+// more in memory.
+func (r *Relation) Close() {
+	r.closeOnce.Do(func() {
+		if r.stopSnapshots != nil {
+			close(r.stopSnapshots)
+		}
+		if r.snapshotPath != "" {
+			if err := r.saveSnapshotFile(); err != nil {
+				log.Println("[Cache] Failed to save snapshot", err)
+			}
+		}
+		r.cache.leavePool()
+	})
+}
+
 // RegisterPeers registers a PeerPicker for choosing remote peer
 func (r *Relation) RegisterPeers(peers PeerPicker) {
 	if r.peers != nil {
@@ -88,14 +250,35 @@ func (r *Relation) RegisterPeers(peers PeerPicker) {
 func (r *Relation) load(key string) (value ByteView, err error) {
 	// each key is only fetched once (either locally or remotely)
 	// regardless of the number of concurrent callers.
-	v, err := r.loader.Do(key,
+	v, err, _ := r.loader.Do(key,
 		func() (interface{}, error) {
 			if r.peers != nil {
-				if peer, ok := r.peers.PickPeer(key); ok {
-					if value, err = r.getFromPeer(peer, key); err == nil {
+				peer, ok := r.peers.PickPeer(key)
+				if ok {
+					value, err = r.getFromPeer(peer, key)
+					if errors.Is(err, ErrPeerDraining) {
+						// the peer is out of the ring now, ask the key's
+						// new owner unless that is this node.
+						peer, ok = r.peers.PickPeer(key)
+						if ok {
+							value, err = r.getFromPeer(peer, key)
+						}
+					}
+				}
+				if ok {
+					if err == nil {
 						return value, nil
 					}
+					if errors.Is(err, ErrValueTooLarge) {
+						// the peer is fine, loading locally won't help.
+						return nil, err
+					}
 					log.Println("[GeeCache] Failed to get from peer", err)
+					if lp, ok := r.peers.(LeasePicker); ok {
+						if leaser, ok := lp.PickLeaser(key); ok {
+							return r.getWithLease(leaser, key)
+						}
+					}
 				}
 			}
 
@@ -111,23 +294,95 @@ func (r *Relation) load(key string) (value ByteView, err error) {
 
 func (r *Relation) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
 	req := &pb.Request{
-		Relation: r.name,
-		Key:      key,
+		Relation:       r.name,
+		Key:            key,
+		AcceptEncoding: r.acceptEncoding(),
 	}
 	res := &pb.Response{}
-	err := peer.Get(req, res)
+	var err error
+	if lg, ok := peer.(limitedGetter); ok {
+		err = lg.getLimited(req, res, r.maxValueSize)
+	} else {
+		err = peer.Get(req, res)
+	}
 	if err != nil {
 		return ByteView{}, err
 	}
-	return ByteView{bytes: res.Value}, nil
+	if err := r.checkSize(int64(len(res.Value))); err != nil {
+		return ByteView{}, err
+	}
+	view := ByteView{
+		bytes:    res.Value,
+		encoding: res.Encoding,
+		stale:    fromUnixNano(res.GetStale()),
+		expire:   fromUnixNano(res.GetExpire()),
+	}
+	if view.stale.IsZero() && view.expire.IsZero() {
+		// the peer's relation has no expiry, or the peer predates it
+		// sending deadlines.
+		r.stamp(&view, time.Now())
+	}
+	// decode right away, the size that matters is the decoded one.
+	return decode(view, r.maxValueSize)
 }
 
-func (r *Relation) getLocally(key string) (ByteView, error) {
-	bytes, err := r.getter.Get(key)
+// getWithLease loads key locally once leaser grants the lease for it, or
+// takes the value loaded by the node that holds the lease.
+func (r *Relation) getWithLease(leaser Leaser, key string) (ByteView, error) {
+	req := &pb.Request{
+		Relation: r.name,
+		Key:      key,
+	}
+	lease, err := leaser.Acquire(req)
 	if err != nil {
+		log.Println("[Cache] Failed to acquire load lease", err)
+		return r.getLocally(key)
+	}
+	if !lease.Granted {
+		if err := r.checkSize(int64(len(lease.Value))); err != nil {
+			return ByteView{}, err
+		}
+		value := ByteView{bytes: lease.Value}
+		r.stamp(&value, time.Now())
+		// cache it as if loaded here, or the next Get would be granted the
+		// released lease and load the key again.
+		value = r.encode(value)
+		r.populateCache(key, value)
+		return value, nil
+	}
+
+	value, err := r.getLocally(key)
+	var loaded []byte
+	if err == nil {
+		var plain ByteView
+		if plain, err = decode(value, r.maxValueSize); err == nil {
+			loaded = plain.rawBytes()
+		}
+	}
+	if err := leaser.Release(req, lease.Token, loaded); err != nil {
+		log.Println("[Cache] Failed to release load lease", err)
+	}
+	return value, err
+}
+
+func (r *Relation) getLocally(key string) (ByteView, error) {
+	var value ByteView
+	if sg, ok := r.getter.(SinkGetter); ok {
+		if err := sg.GetSink(key, ByteViewSink(&value)); err != nil {
+			return ByteView{}, err
+		}
+	} else {
+		bytes, err := r.getter.Get(key)
+		if err != nil {
+			return ByteView{}, err
+		}
+		value = ByteView{bytes: cloneBytes(bytes)}
+	}
+	if err := r.checkSize(int64(value.Len())); err != nil {
 		return ByteView{}, err
 	}
-	value := ByteView{bytes: cloneBytes(bytes)}
+	r.stamp(&value, time.Now())
+	value = r.encode(value)
 	r.populateCache(key, value)
 	return value, nil
 }
@@ -3,10 +3,17 @@ package ocache
 import (
 	"flag"
 	"fmt"
+	"github.com/nohsueh/ocache/arena"
+	"github.com/nohsueh/ocache/disk"
+	"github.com/nohsueh/ocache/lru"
 	"log"
 	"net/http"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_Getter(t *testing.T) {
@@ -58,6 +65,279 @@ func Test_Get(t *testing.T) {
 	}
 }
 
+func Test_GetArena(t *testing.T) {
+	loads := 0
+	r := NewRelation("Arena", 1<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(db[key]), nil
+		},
+	), WithArena())
+
+	for k, v := range db {
+		if view, err := r.Get(k); err != nil || view.String() != v {
+			t.Fatalf("Failed to get bytes of %s", k)
+		}
+	}
+	for k := range db {
+		if _, err := r.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != len(db) {
+		t.Fatalf("expect %d loads, got %d", len(db), loads)
+	}
+}
+
+func Test_SetCapacityArena(t *testing.T) {
+	loads := 0
+	r := NewRelation("ArenaResize", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(db[key]), nil
+		},
+	), WithArena())
+	for k := range db {
+		if _, err := r.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, bytes := range []int64{0, arena.MinCap - 1} {
+		if err := r.SetCapacity(bytes); err == nil {
+			t.Fatalf("SetCapacity(%d) succeeded", bytes)
+		}
+	}
+	if err := r.SetCapacity(1 << 10); err != nil {
+		t.Fatal(err)
+	}
+	if items := r.CacheStats().Items; items != int64(len(db)) {
+		t.Fatalf("%d of %d entries moved to the arena", items, len(db))
+	}
+	for k, v := range db {
+		if view, err := r.Get(k); err != nil || view.String() != v {
+			t.Fatalf("Get(%s) = %v, %v", k, view, err)
+		}
+	}
+	if _, err := r.Get("Sam"); err != nil || loads != len(db) {
+		t.Fatalf("expect %d loads, got %d: %v", len(db), loads, err)
+	}
+}
+
+func Test_CacheStats(t *testing.T) {
+	r := NewRelation("Stats", 64, GetterFunc(
+		func(key string) ([]byte, error) {
+			return make([]byte, len(key)*8), nil
+		},
+	), WithMaxEntryFraction(0.5))
+
+	for _, k := range []string{"a", "b", "cccc"} {
+		if _, err := r.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _ = r.Get("a")
+
+	s := r.CacheStats()
+	if s.Items != 2 || s.Bytes != 18 || s.Rejections != 1 || s.Hits != 1 || s.Gets != 4 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func Test_Evictions(t *testing.T) {
+	c := &Cache{cap: 64, maxEntryFraction: 0.5}
+	c.add("removed", ByteView{bytes: make([]byte, 8)})
+	c.remove("removed")
+	c.add("expired", ByteView{bytes: make([]byte, 8), expire: time.Now().Add(-time.Second)})
+	c.get("expired")
+	c.add("replaced", ByteView{bytes: make([]byte, 8)})
+	c.add("replaced", ByteView{bytes: make([]byte, 40)})
+	if s := c.stats(); s.Evictions != 0 || s.Items != 0 || s.Rejections != 1 {
+		t.Fatalf("drops counted as evictions: %+v", s)
+	}
+
+	for i := 0; i < 8; i++ {
+		c.add(strconv.Itoa(i), ByteView{bytes: make([]byte, 15)})
+	}
+	if s := c.stats(); s.Evictions != 4 || s.Items != 4 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func Test_EntryOverhead(t *testing.T) {
+	r := NewRelation("Overhead", 3*(lru.DefaultEntryOverhead+4), GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		},
+	), WithEntryOverhead(lru.DefaultEntryOverhead))
+
+	for _, k := range []string{"k1", "k2", "k3", "k4"} {
+		if _, err := r.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := r.CacheStats(); s.Items != 3 || s.Bytes != 3*(lru.DefaultEntryOverhead+4) {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func Test_MemoryPool(t *testing.T) {
+	pool := NewMemoryPool(400)
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return make([]byte, 6), nil
+	})
+	low := NewRelation("PoolLow", 0, getter, WithMemoryPool(pool, 1))
+	high := NewRelation("PoolHigh", 0, getter, WithMemoryPool(pool, 3))
+
+	for i := 0; i < 100; i++ {
+		for _, r := range []*Relation{low, high} {
+			if _, err := r.Get(fmt.Sprintf("k%03d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if size := pool.Size(); size > pool.Limit() {
+		t.Fatalf("pool over limit: %d > %d", size, pool.Limit())
+	}
+	ls, hs := low.CacheStats(), high.CacheStats()
+	if ls.Bytes != 100 || hs.Bytes != 300 {
+		t.Fatalf("expect 1:3 split of the pool, got %d:%d", ls.Bytes, hs.Bytes)
+	}
+	if hs.PoolShare != 0.75 || hs.Evictions == 0 {
+		t.Fatalf("unexpected stats %+v", hs)
+	}
+}
+
+func Test_MemoryPoolClose(t *testing.T) {
+	pool := NewMemoryPool(400)
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return make([]byte, 6), nil
+	})
+	store, err := disk.Open(filepath.Join(t.TempDir(), "l2"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	closed := NewRelation("PoolClosed", 0, getter, WithMemoryPool(pool, 1), WithDiskStore(store))
+	open := NewRelation("PoolOpen", 0, getter, WithMemoryPool(pool, 1))
+	for i := 0; i < 10; i++ {
+		closed.Get(fmt.Sprintf("k%d", i))
+		open.Get(fmt.Sprintf("k%d", i))
+	}
+	if err := store.Put("on disk", arenaValue(ByteView{bytes: []byte("v")})); err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if n := store.Len(); n != 1 {
+		t.Fatalf("leaving the pool left %d entries on disk, want the disk store untouched", n)
+	}
+
+	if size, bytes := pool.Size(), open.CacheStats().Bytes; size != bytes {
+		t.Fatalf("pool counts %d bytes, its only member holds %d", size, bytes)
+	}
+	if _, err := closed.Get("k0"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes := closed.CacheStats().Bytes; bytes != 0 {
+		t.Fatalf("closed relation keeps %d bytes", bytes)
+	}
+}
+
+func Test_DiskStore(t *testing.T) {
+	for _, opts := range [][]RelationOption{nil, {WithArena()}} {
+		store, err := disk.Open(filepath.Join(t.TempDir(), "l2"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		var loads int32
+		r := NewRelation("L2", 100, GetterFunc(
+			func(key string) ([]byte, error) {
+				atomic.AddInt32(&loads, 1)
+				return []byte("value of " + key), nil
+			},
+		), append(opts, WithDiskStore(store))...)
+
+		for i := 0; i < 20; i++ {
+			if _, err := r.Get(fmt.Sprintf("k%02d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if s := r.CacheStats(); s.Evictions == 0 || s.L2Items != s.Evictions {
+			t.Fatalf("evicted entries not moved to disk: %+v", s)
+		}
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			if view, err := r.Get(key); err != nil || view.String() != "value of "+key {
+				t.Fatalf("Get(%s) = %q, %v", key, view.String(), err)
+			}
+		}
+		if loads != 20 {
+			t.Fatalf("expect misses to be served from disk, got %d loads", loads)
+		}
+		if s := r.CacheStats(); s.L2Hits == 0 {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+	}
+}
+
+// versionGetter returns how many times it has been called so far.
+func versionGetter(loads *int32) Getter {
+	return GetterFunc(func(key string) ([]byte, error) {
+		return []byte(strconv.Itoa(int(atomic.AddInt32(loads, 1)))), nil
+	})
+}
+
+func waitLoads(t *testing.T, loads *int32, n int32) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(loads) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d loads, got %d", n, atomic.LoadInt32(loads))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_StaleWhileRevalidate(t *testing.T) {
+	var loads int32
+	r := NewRelation("Stale", 0, versionGetter(&loads), WithExpiry(20*time.Millisecond, time.Hour))
+
+	if view, _ := r.Get("key"); view.String() != "1" {
+		t.Fatalf("expect first load, got %s", view)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if view, _ := r.Get("key"); view.String() != "1" {
+		t.Fatalf("stale value should be served, got %s", view)
+	}
+	waitLoads(t, &loads, 2)
+	time.Sleep(10 * time.Millisecond)
+	if view, _ := r.Get("key"); view.String() != "2" {
+		t.Fatalf("expect refreshed value, got %s", view)
+	}
+}
+
+func Test_RefreshAhead(t *testing.T) {
+	var loads int32
+	r := NewRelation("Ahead", 0, versionGetter(&loads),
+		WithExpiry(0, 100*time.Millisecond), WithRefreshAhead(80*time.Millisecond))
+
+	_, _ = r.Get("key")
+	_, _ = r.Get("key")
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("fresh value refreshed, %d loads", n)
+	}
+	time.Sleep(30 * time.Millisecond)
+	_, _ = r.Get("key")
+	waitLoads(t, &loads, 2)
+
+	// without reads the value hard expires and is loaded synchronously.
+	time.Sleep(150 * time.Millisecond)
+	if view, _ := r.Get("key"); view.String() != "3" {
+		t.Fatalf("expect reload after hard expiry, got %s", view)
+	}
+}
+
 func createRelation() *Relation {
 	return NewRelation("Person", 2<<10, GetterFunc(
 		func(key string) ([]byte, error) {
@@ -78,23 +358,9 @@ func startCacheServer(addr string, addrs []string, r *Relation) {
 }
 
 func startAPIServer(apiAddr string, c *Relation) {
-	http.Handle("/api", http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			key := r.URL.Query().Get("key")
-			view, err := c.Get(key)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/octet-stream")
-			_, err = w.Write(view.ByteSlice())
-			if err != nil {
-				return
-			}
-		}))
+	http.Handle("/api/", http.StripPrefix("/api", APIHandler{}))
 	log.Println("Frontend server is running at", apiAddr)
 	log.Fatal(http.ListenAndServe(apiAddr[7:], nil))
-
 }
 
 func Test_Server(t *testing.T) {
@@ -0,0 +1,209 @@
+package ocache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of an HTTPOriginGetter.
+const (
+	DefaultOriginRetries = 2
+	DefaultOriginBackoff = 100 * time.Millisecond
+)
+
+// An HTTPOriginGetter loads values from an HTTP service, making the
+// relation a caching reverse proxy in front of it. It GETs the URL of a
+// key and caches the response body until the response's Cache-Control or
+// Expires header says it goes stale, or for the relation's expiry if it
+// has neither. Responses marked no-store, no-cache or private are served
+// once but not kept. 404 Not Found is reported as ErrNotFound; network
+// errors, 429 Too Many Requests and 5xx responses are retried with
+// exponential backoff.
+type HTTPOriginGetter struct {
+	template string
+	client   *http.Client
+	sem      chan struct{} // nil for no limit
+	retries  int
+	backoff  time.Duration
+}
+
+// An OriginOption configures an HTTPOriginGetter created by
+// NewHTTPOriginGetter.
+type OriginOption func(*HTTPOriginGetter)
+
+// WithOriginClient sends the requests to the origin with client instead
+// of http.DefaultClient, e.g. to set a timeout.
+func WithOriginClient(client *http.Client) OriginOption {
+	return func(g *HTTPOriginGetter) {
+		g.client = client
+	}
+}
+
+// WithOriginConcurrency limits the requests in flight to the origin to n.
+// Loads beyond it wait for a slot.
+func WithOriginConcurrency(n int) OriginOption {
+	return func(g *HTTPOriginGetter) {
+		if n > 0 {
+			g.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithOriginRetries retries a failed request up to retries times, waiting
+// backoff, doubled after every attempt and with up to half of it added at
+// random, in between. With retries = 0 failures are not retried.
+func WithOriginRetries(retries int, backoff time.Duration) OriginOption {
+	return func(g *HTTPOriginGetter) {
+		g.retries, g.backoff = retries, backoff
+	}
+}
+
+// NewHTTPOriginGetter returns a Getter for the origin URLs given by
+// template, in which "{key}" stands for the key escaped as a path segment,
+// e.g. "http://users.internal/users/{key}". By default it retries
+// DefaultOriginRetries times after DefaultOriginBackoff and doesn't limit
+// concurrency.
+func NewHTTPOriginGetter(template string, opts ...OriginOption) *HTTPOriginGetter {
+	if !strings.Contains(template, "{key}") {
+		panic("ocache: origin URL template without {key}")
+	}
+	g := &HTTPOriginGetter{
+		template: template,
+		client:   http.DefaultClient,
+		retries:  DefaultOriginRetries,
+		backoff:  DefaultOriginBackoff,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// errRetryable marks the failures worth another attempt.
+var errRetryable = errors.New("retryable")
+
+// Get implements Getter.
+func (g *HTTPOriginGetter) Get(key string) ([]byte, error) {
+	value, _, err := g.fetch(key)
+	return value, err
+}
+
+// GetSink implements SinkGetter, passing on the expiry of the response.
+func (g *HTTPOriginGetter) GetSink(key string, dest Sink) error {
+	value, expire, err := g.fetch(key)
+	if err != nil {
+		return err
+	}
+	return dest.SetBytes(value, expire)
+}
+
+// fetch GETs the value of key, retrying failures.
+func (g *HTTPOriginGetter) fetch(key string) ([]byte, time.Time, error) {
+	u := strings.ReplaceAll(g.template, "{key}", url.PathEscape(key))
+	backoff := g.backoff
+	for attempt := 0; ; attempt++ {
+		value, expire, err := g.fetchOnce(u)
+		if err == nil || !errors.Is(err, errRetryable) || attempt >= g.retries {
+			return value, expire, err
+		}
+		log.Println("[Origin] Retrying", err)
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff)/2+1)))
+		backoff *= 2
+	}
+}
+
+func (g *HTTPOriginGetter) fetchOnce(u string) ([]byte, time.Time, error) {
+	if g.sem != nil {
+		g.sem <- struct{}{}
+		defer func() { <-g.sem }()
+	}
+
+	res, err := g.client.Get(u)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w: %v", errRetryable, err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, time.Time{}, fmt.Errorf("%w: %s", ErrNotFound, u)
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return nil, time.Time{}, fmt.Errorf("%w: origin returned %v for %s", errRetryable, res.Status, u)
+	case res.StatusCode != http.StatusOK:
+		return nil, time.Time{}, fmt.Errorf("origin returned %v for %s", res.Status, u)
+	}
+	value, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w: %v", errRetryable, err)
+	}
+	return value, originExpiry(res.Header, time.Now()), nil
+}
+
+// originExpiry returns when a response with header received at now goes
+// stale for a shared cache, or the zero time if the header doesn't say.
+func originExpiry(header http.Header, now time.Time) time.Time {
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return now
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sMaxAge = parseSeconds(value)
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge >= 0 {
+		// the response may have spent part of its lifetime in other caches.
+		if age := parseSeconds(header.Get("Age")); age > 0 {
+			maxAge -= age
+		}
+		if maxAge <= 0 {
+			return now
+		}
+		return now.Add(time.Duration(maxAge) * time.Second)
+	}
+
+	expires := header.Get("Expires")
+	if expires == "" {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(expires)
+	if err != nil {
+		// invalid dates, like "0", mean already expired.
+		return now
+	}
+	// use the origin's clock for the lifetime, not ours.
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		t = now.Add(t.Sub(date))
+	}
+	if !t.After(now) {
+		return now
+	}
+	return t
+}
+
+// parseSeconds parses a delta-seconds value, -1 if it isn't one.
+func parseSeconds(s string) int {
+	n, err := strconv.Atoi(strings.Trim(s, `"`))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+var (
+	_ Getter     = (*HTTPOriginGetter)(nil)
+	_ SinkGetter = (*HTTPOriginGetter)(nil)
+)
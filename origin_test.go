@@ -0,0 +1,156 @@
+package ocache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_HTTPOriginGetter(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.EscapedPath()
+		mu.Lock()
+		hits[path]++
+		n := hits[path]
+		mu.Unlock()
+		switch path {
+		case "/items/a%2Fb":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Write([]byte("a/b"))
+		case "/items/uncached":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("uncached"))
+		case "/items/flaky":
+			if n < 3 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("flaky"))
+		case "/items/down":
+			http.Error(w, "down", http.StatusInternalServerError)
+		case "/items/forbidden":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer origin.Close()
+
+	r := NewRelation("Origin", 1<<10, NewHTTPOriginGetter(origin.URL+"/items/{key}",
+		WithOriginRetries(2, time.Millisecond)), WithExpiry(0, time.Hour))
+	for i := 0; i < 2; i++ {
+		view, err := r.Get("a/b")
+		if err != nil || view.String() != "a/b" {
+			t.Fatalf("Get(a/b) = %v, %v", view, err)
+		}
+		if d := time.Until(view.Expire()); d < 59*time.Second || d > 60*time.Second {
+			t.Fatalf("a/b expires in %v, want the origin's max-age", d)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if view, err := r.Get("uncached"); err != nil || view.String() != "uncached" {
+			t.Fatalf("Get(uncached) = %v, %v", view, err)
+		}
+	}
+	if view, err := r.Get("flaky"); err != nil || view.String() != "flaky" {
+		t.Fatalf("Get(flaky) = %v, %v", view, err)
+	}
+	if _, err := r.Get("down"); err == nil {
+		t.Fatalf("Get(down) succeeded")
+	}
+	if _, err := r.Get("forbidden"); err == nil {
+		t.Fatalf("Get(forbidden) succeeded")
+	}
+	if _, err := r.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(missing) = %v, want ErrNotFound", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for path, want := range map[string]int{
+		"/items/a%2Fb":     1,
+		"/items/uncached":  2,
+		"/items/flaky":     3,
+		"/items/down":      3,
+		"/items/forbidden": 1,
+		"/items/missing":   1,
+	} {
+		if hits[path] != want {
+			t.Fatalf("origin got %d requests for %s, want %d", hits[path], path, want)
+		}
+	}
+}
+
+func Test_OriginConcurrency(t *testing.T) {
+	var inFlight, most int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("value"))
+	}))
+	defer origin.Close()
+
+	g := NewHTTPOriginGetter(origin.URL+"/{key}", WithOriginConcurrency(2))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := g.Get(strconv.Itoa(i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Fatalf("%d requests in flight, want 2", most)
+	}
+}
+
+func Test_OriginExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Add(-time.Hour).Format(http.TimeFormat) // the origin's clock is late.
+	for _, tt := range []struct {
+		header map[string]string
+		want   time.Duration // -1 for no expiry
+	}{
+		{nil, -1},
+		{map[string]string{"Cache-Control": "max-age=60"}, time.Minute},
+		{map[string]string{"Cache-Control": "max-age=60, s-maxage=10"}, 10 * time.Second},
+		{map[string]string{"Cache-Control": "max-age=60", "Age": "20"}, 40 * time.Second},
+		{map[string]string{"Cache-Control": "max-age=60", "Age": "90"}, 0},
+		{map[string]string{"Cache-Control": "public, no-cache"}, 0},
+		{map[string]string{"Cache-Control": "private, max-age=60"}, 0},
+		{map[string]string{"Cache-Control": "max-age=bogus"}, -1},
+		{map[string]string{"Cache-Control": "max-age=60", "Expires": now.Add(time.Hour).Format(http.TimeFormat)}, time.Minute},
+		{map[string]string{"Expires": now.Add(-30 * time.Minute).Format(http.TimeFormat), "Date": date}, 30 * time.Minute},
+		{map[string]string{"Expires": now.Add(-30 * time.Minute).Format(http.TimeFormat)}, 0},
+		{map[string]string{"Expires": "0"}, 0},
+	} {
+		header := http.Header{}
+		for k, v := range tt.header {
+			header.Set(k, v)
+		}
+		got := originExpiry(header, now)
+		switch {
+		case tt.want < 0 && !got.IsZero():
+			t.Fatalf("originExpiry(%v) = %v, want none", tt.header, got)
+		case tt.want >= 0 && !got.Equal(now.Add(tt.want)):
+			t.Fatalf("originExpiry(%v) = %v, want %v", tt.header, got.Sub(now), tt.want)
+		}
+	}
+}
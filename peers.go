@@ -1,6 +1,9 @@
 package ocache
 
-import pb "github.com/nohsueh/ocache/ocachepb"
+import (
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"io"
+)
 
 // PeerPicker is the interface that must be implemented to locate the peer that
 // owns a specific key.
@@ -12,3 +15,41 @@ type PeerPicker interface {
 type PeerGetter interface {
 	Get(in *pb.Request, out *pb.Response) error
 }
+
+// LeasePicker is implemented by a PeerPicker that can name a deterministic
+// coordinator for loads of a key whose owner is unreachable.
+type LeasePicker interface {
+	PickLeaser(key string) (leaser Leaser, ok bool)
+}
+
+// A Leaser grants cluster-wide leases to load a key, so that while its
+// owner is unreachable only one node at a time calls its Getter.
+type Leaser interface {
+	// Acquire asks for the lease on a key. If the lease is granted the
+	// caller must load the value and Release the lease. If another node
+	// holds it, Acquire waits for that node and returns the value it
+	// loaded instead.
+	Acquire(in *pb.Request) (*Lease, error)
+	// Release gives the lease back, handing value to the nodes waiting
+	// for it. A nil value means the load failed and a waiter may retry.
+	Release(in *pb.Request, token string, value []byte) error
+}
+
+// A Lease is the result of Leaser.Acquire.
+type Lease struct {
+	Granted bool
+	Token   string // identifies a granted lease in Release
+	Value   []byte // loaded by the holder when the lease was not granted
+}
+
+// StreamGetter is implemented by a PeerGetter that can stream values
+// instead of returning them in a single Response.
+type StreamGetter interface {
+	GetStream(in *pb.Request) (io.ReadCloser, error)
+}
+
+// limitedGetter is implemented by a PeerGetter that can refuse a value
+// larger than max bytes before buffering it, no limit if max <= 0.
+type limitedGetter interface {
+	getLimited(in *pb.Request, out *pb.Response, max int64) error
+}
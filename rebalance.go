@@ -0,0 +1,426 @@
+package ocache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/nohsueh/ocache/consistenthash"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// transferPrefix is the path, below the pool's base path, that peers POST
+// handed off entries to, as length-delimited pb.Entry messages.
+const transferPrefix = "_transfer/"
+
+// maxTransferValue bounds the values handed off for relations without
+// WithMaxValueSize.
+const maxTransferValue = 64 << 20
+
+// transferEntryOverhead is the room a pb.Entry takes besides its value:
+// the key, relation name, encoding and deadlines.
+const transferEntryOverhead = 16 << 10
+
+// transferBatchSize is about how many bytes of entries a handoff sends per
+// request. A batch may exceed it by one entry.
+const transferBatchSize = 4 << 20
+
+// errRingChanged stops a handoff made obsolete by a newer ring.
+var errRingChanged = errors.New("ring changed again")
+
+// RebalanceStats are returned by HTTPPool.RebalanceStats.
+type RebalanceStats struct {
+	// Rebalances counts the ring changes that started a handoff.
+	Rebalances int64 `json:"rebalances"`
+	// Pending is the number of entries the running handoff has yet to
+	// send, 0 if none is running.
+	Pending int64 `json:"pending"`
+	// Moved and MovedBytes count the entries handed off to their new
+	// owners, Failed those that could not be.
+	Moved      int64 `json:"moved"`
+	MovedBytes int64 `json:"moved_bytes"`
+	Failed     int64 `json:"failed"`
+	// Received counts the entries other peers handed off to this one.
+	Received int64 `json:"received"`
+}
+
+type rebalancer struct {
+	rate  int64 // bytes per second, 0 for no limit
+	mu    sync.Mutex
+	gen   int64 // bumped by every ring change
+	stats RebalanceStats
+}
+
+// WithRebalancing hands cached entries off to their new owners whenever
+// Set changes the ring, instead of leaving them orphaned while the new
+// owners start cold. Transfers are throttled to bytesPerSecond, or not
+// at all if it is 0. Every peer should enable it.
+//
+// Peers only take entries from one another: the identity of the sender,
+// from WithPeerVerification or an Authenticator such as HMACAuth with
+// Keys, must be its URL as passed to Set.
+func WithRebalancing(bytesPerSecond int64) PoolOption {
+	return func(p *HTTPPool) {
+		p.rebalance = &rebalancer{rate: bytesPerSecond}
+	}
+}
+
+// RebalanceStats returns the progress of handoffs to and from this peer.
+func (p *HTTPPool) RebalanceStats() RebalanceStats {
+	if p.rebalance == nil {
+		return RebalanceStats{}
+	}
+	p.rebalance.mu.Lock()
+	defer p.rebalance.mu.Unlock()
+	return p.rebalance.stats
+}
+
+// startHandoff starts handing off the entries ring assigns to other peers.
+// A handoff still running for an older ring stops. The returned channel
+// is closed when the handoff is over.
+func (p *HTTPPool) startHandoff(ring *consistenthash.Map) <-chan struct{} {
+	rb := p.rebalance
+	rb.mu.Lock()
+	rb.gen++
+	gen := rb.gen
+	rb.stats.Rebalances++
+	rb.stats.Pending = 0
+	rb.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.handoff(ring, gen)
+	}()
+	return done
+}
+
+// stopHandoff stops the running handoff, if any.
+func (p *HTTPPool) stopHandoff() {
+	rb := p.rebalance
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.gen++
+	rb.stats.Pending = 0
+}
+
+type handoffEntry struct {
+	relation *Relation
+	cacheEntry
+}
+
+func (p *HTTPPool) handoff(ring *consistenthash.Map, gen int64) {
+	byOwner := make(map[string][]handoffEntry)
+	var owners []string
+	var pending int64
+	for _, r := range p.relations() {
+		for _, e := range r.cache.entries() {
+			owner := ring.Get(e.key)
+			if owner == "" || owner == p.host {
+				continue
+			}
+			if byOwner[owner] == nil {
+				owners = append(owners, owner)
+			}
+			byOwner[owner] = append(byOwner[owner], handoffEntry{r, e})
+			pending++
+		}
+	}
+	if !p.updateRebalance(gen, func(s *RebalanceStats) { s.Pending = pending }) {
+		return
+	}
+
+	for _, owner := range owners {
+		entries := byOwner[owner]
+		accepted, err := p.transfer(owner+p.path+transferPrefix, entries, gen)
+		if errors.Is(err, errRingChanged) {
+			return
+		}
+		if failed := len(entries) - len(accepted); err != nil {
+			p.Log("Failed to hand off %d entries to %s: %v", failed, owner, err)
+		} else if failed > 0 {
+			p.Log("%s refused %d of %d handed off entries", owner, failed, len(entries))
+		}
+		// entries the owner didn't take are kept.
+		var movedBytes int64
+		for _, e := range accepted {
+			e.relation.cache.remove(e.key)
+			movedBytes += int64(e.view.Len())
+		}
+		if !p.updateRebalance(gen, func(s *RebalanceStats) {
+			s.Pending -= int64(len(entries))
+			s.Moved += int64(len(accepted))
+			s.MovedBytes += movedBytes
+			s.Failed += int64(len(entries) - len(accepted))
+		}) {
+			return
+		}
+	}
+}
+
+// updateRebalance applies f to the stats unless ring gen is obsolete.
+func (p *HTTPPool) updateRebalance(gen int64, f func(*RebalanceStats)) bool {
+	rb := p.rebalance
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.gen != gen {
+		return false
+	}
+	f(&rb.stats)
+	return true
+}
+
+func (p *HTTPPool) current(gen int64) bool {
+	return p.updateRebalance(gen, func(*RebalanceStats) {})
+}
+
+// relations lists the relations served through this pool.
+func (p *HTTPPool) relations() []*Relation {
+	mu.RLock()
+	defer mu.RUnlock()
+	var list []*Relation
+	for _, r := range relations {
+		if r.peers == PeerPicker(p) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// transfer sends entries to url at the configured rate and returns those
+// the peer accepted, including when a later batch failed. They are sent in
+// batches of about transferBatchSize, each signed as a whole by the pool's
+// Authenticator.
+func (p *HTTPPool) transfer(url string, entries []handoffEntry, gen int64) ([]handoffEntry, error) {
+	batchSize := int64(transferBatchSize)
+	if rate := p.rebalance.rate; rate > 0 && rate < batchSize {
+		// a batch a second at most, to keep the rate smooth.
+		batchSize = rate
+	}
+	var accepted []handoffEntry
+	var sent int64
+	start := time.Now()
+	for len(entries) > 0 {
+		if !p.current(gen) {
+			return accepted, errRingChanged
+		}
+		var body bytes.Buffer
+		var size int64
+		n := 0
+		for n < len(entries) && int64(body.Len()) < batchSize {
+			view := entries[n].view
+			entry := &pb.Entry{
+				Relation: entries[n].relation.name,
+				Key:      entries[n].key,
+				Value:    view.rawBytes(),
+				Encoding: view.encoding,
+				Stale:    unixNano(view.stale),
+				Expire:   unixNano(view.expire),
+			}
+			if _, err := protodelim.MarshalTo(&body, entry); err != nil {
+				return accepted, err
+			}
+			size += int64(view.Len())
+			n++
+		}
+		batch := entries[:n]
+		entries = entries[n:]
+		refused, err := p.postTransfer(url, body.Bytes())
+		if err != nil {
+			if !p.current(gen) {
+				return accepted, errRingChanged
+			}
+			return accepted, err
+		}
+		skip := make(map[uint32]bool, len(refused))
+		for _, i := range refused {
+			skip[i] = true
+		}
+		for i, e := range batch {
+			if !skip[uint32(i)] {
+				accepted = append(accepted, e)
+			}
+		}
+		sent += size
+		if rate := p.rebalance.rate; rate > 0 {
+			due := time.Duration(sent * int64(time.Second) / rate)
+			if d := due - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}
+	return accepted, nil
+}
+
+// postTransfer sends a batch of entries to url and returns the indexes of
+// those the peer refused.
+func (p *HTTPPool) postTransfer(url string, body []byte) ([]uint32, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if p.Draining() {
+		// the owners check against a ring without this peer.
+		req.Header.Set(statusHeader, statusDraining)
+	}
+	res, err := do(p.client, p.auth, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned: %v", res.Status)
+	}
+	// an index takes less room than the entry it refuses.
+	b, err := io.ReadAll(io.LimitReader(res.Body, int64(len(body))+1<<10))
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %v", err)
+	}
+	var out pb.TransferResponse
+	if err := proto.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("decoding response body: %v", err)
+	}
+	return out.GetRefused(), nil
+}
+
+// serveTransfer adds the entries handed off by another peer to their
+// relations, and answers with a pb.TransferResponse listing those it
+// refused. Only peers passed to Set may hand entries off, and a draining
+// one is dropped from the ring first.
+func (p *HTTPPool) serveTransfer(w http.ResponseWriter, request *http.Request, identity string) {
+	if p.rebalance == nil {
+		http.Error(w, "Rebalancing disabled", http.StatusNotFound)
+		return
+	}
+	if request.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.isMember(identity) {
+		p.Log("Refused handoff from %q, not a peer", identity)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if request.Header.Get(statusHeader) == statusDraining {
+		// a peer shutting down hands off the keys it owned: they are ours
+		// once it is out of the ring.
+		p.dropPeer(identity)
+	}
+
+	// the batch is only used once read in full, for an Authenticator may
+	// find the body was tampered with at its end.
+	maxSize := p.maxTransferSize()
+	br := bufio.NewReader(http.MaxBytesReader(w, request.Body, transferBatchSize+maxSize))
+	opts := protodelim.UnmarshalOptions{MaxSize: maxSize}
+	var entries []*pb.Entry
+	for {
+		entry := &pb.Entry{}
+		err := opts.UnmarshalFrom(br, entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entries = append(entries, entry)
+	}
+	res := &pb.TransferResponse{}
+	for i, entry := range entries {
+		if !p.acceptEntry(entry, identity) {
+			res.Refused = append(res.Refused, uint32(i))
+		}
+	}
+	body, err := proto.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.rebalance.mu.Lock()
+	p.rebalance.stats.Received += int64(len(entries) - len(res.Refused))
+	p.rebalance.mu.Unlock()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(body)
+}
+
+// isMember reports whether identity is one of the peers passed to Set,
+// drained or not.
+func (p *HTTPPool) isMember(identity string) bool {
+	if identity == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, peer := range p.members {
+		if peer == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTransferSize is the largest pb.Entry a peer may hand off, given the
+// relations served through the pool.
+func (p *HTTPPool) maxTransferSize() int64 {
+	var max int64
+	for _, r := range p.relations() {
+		size := r.maxValueSize
+		if size <= 0 || size > maxTransferValue {
+			size = maxTransferValue
+		}
+		if size > max {
+			max = size
+		}
+	}
+	return max + transferEntryOverhead
+}
+
+// acceptEntry caches an entry handed off by the caller identity unless it
+// can't be used: its relation isn't served through the pool or the caller
+// may not read it, this node doesn't own its key, or its value is expired,
+// too large or can't be decoded.
+func (p *HTTPPool) acceptEntry(entry *pb.Entry, identity string) bool {
+	key := entry.GetKey()
+	r := GetRelation(entry.GetRelation())
+	if r == nil || r.peers != PeerPicker(p) || key == "" || len(key) > MaxKeyLength {
+		return false
+	}
+	if !r.canRead(identity) {
+		p.Log("Refused entry of relation %s from %q", r.name, identity)
+		return false
+	}
+	p.mu.Lock()
+	owner := p.host
+	if p.peers != nil {
+		owner = p.peers.Get(key)
+	}
+	p.mu.Unlock()
+	if owner != p.host {
+		return false
+	}
+
+	view := ByteView{
+		bytes:    entry.GetValue(),
+		encoding: entry.GetEncoding(),
+		stale:    fromUnixNano(entry.GetStale()),
+		expire:   fromUnixNano(entry.GetExpire()),
+	}
+	if view.expired(time.Now()) || r.checkSize(int64(view.Len())) != nil {
+		return false
+	}
+	if view.encoding != "" {
+		if _, err := decode(view, r.maxValueSize); err != nil {
+			return false
+		}
+	}
+	r.populateCache(key, view)
+	return true
+}
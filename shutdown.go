@@ -0,0 +1,165 @@
+package ocache
+
+import (
+	"context"
+	"errors"
+	"github.com/nohsueh/ocache/consistenthash"
+	"net/http"
+	"time"
+)
+
+// statusHeader is set to statusDraining on the responses of a peer that
+// is shutting down, so that callers reroute rather than retry it.
+const (
+	statusHeader   = "X-Ocache-Status"
+	statusDraining = "draining"
+)
+
+// ErrPeerDraining is returned by peers that are shutting down. The pool
+// that picked such a peer drops it from its ring for drainedPeerTTL.
+var ErrPeerDraining = errors.New("ocache: peer is draining")
+
+// drainedPeerTTL is how long a draining peer stays out of the ring. It is
+// let back in afterwards, so that it serves its keys again once restarted.
+var drainedPeerTTL = 30 * time.Second
+
+// Shutdown takes the peer out of service. It refuses new requests with a
+// draining status that makes other peers drop it from their rings, waits
+// for the requests being served, hands cached entries off to their new
+// owners when WithRebalancing is enabled, and stops background work such
+// as lease timers and the snapshots of the relations served through the
+// pool, which save a last snapshot. If ctx is done first, Shutdown stops
+// waiting and returns its error.
+func (p *HTTPPool) Shutdown(ctx context.Context) error {
+	p.drainMu.Lock()
+	if !p.draining {
+		p.draining = true
+		if p.active == 0 {
+			close(p.idle)
+		}
+	}
+	p.drainMu.Unlock()
+	p.Log("Draining")
+
+	if p.leases != nil {
+		// wakes up the requests waiting for a lease.
+		p.leases.close()
+	}
+	select {
+	case <-p.idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if p.rebalance != nil {
+		if ring := p.ringWithout(p.host); ring != nil {
+			select {
+			case <-p.startHandoff(ring):
+			case <-ctx.Done():
+				p.stopHandoff()
+				return ctx.Err()
+			}
+		} else {
+			p.stopHandoff()
+		}
+	}
+
+	for _, r := range p.relations() {
+		r.Close()
+	}
+	return nil
+}
+
+// Draining reports whether Shutdown has been called.
+func (p *HTTPPool) Draining() bool {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	return p.draining
+}
+
+// enter admits a request unless the pool is draining.
+func (p *HTTPPool) enter() bool {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	if p.draining {
+		return false
+	}
+	p.active++
+	return true
+}
+
+func (p *HTTPPool) leave() {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	p.active--
+	if p.draining && p.active == 0 {
+		close(p.idle)
+	}
+}
+
+// ringWithout returns the ring without peer, or nil if no peer is left.
+func (p *HTTPPool) ringWithout(peer string) *consistenthash.Map {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rest := without(p.ringMembersLocked(), peer)
+	if len(rest) == 0 {
+		return nil
+	}
+	ring := consistenthash.New(defaultReplicas, nil)
+	ring.Add(rest...)
+	return ring
+}
+
+// dropPeer takes a draining peer out of the ring for drainedPeerTTL.
+func (p *HTTPPool) dropPeer(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.httpGetters[peer]; !ok {
+		return
+	}
+	p.Log("Peer %s is draining", peer)
+	if p.drained == nil {
+		p.drained = make(map[string]time.Time)
+	}
+	p.drained[peer] = time.Now().Add(drainedPeerTTL)
+	p.buildRingLocked()
+	time.AfterFunc(drainedPeerTTL, func() {
+		p.readmitPeer(peer)
+	})
+}
+
+// readmitPeer puts a peer dropped by dropPeer back in the ring once its
+// time is up, unless Set replaced the peers meanwhile.
+func (p *HTTPPool) readmitPeer(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	until, ok := p.drained[peer]
+	if !ok || time.Now().Before(until) {
+		return
+	}
+	delete(p.drained, peer)
+	p.Log("Peer %s is back in the ring", peer)
+	p.buildRingLocked()
+}
+
+func without(peers []string, peer string) []string {
+	var rest []string
+	for _, m := range peers {
+		if m != peer {
+			rest = append(rest, m)
+		}
+	}
+	return rest
+}
+
+// isDraining reports whether res comes from a draining peer, and has the
+// pool drop it if so.
+func (h *httpGetter) isDraining(res *http.Response) bool {
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get(statusHeader) != statusDraining {
+		return false
+	}
+	if h.pool != nil {
+		h.pool.dropPeer(h.peer)
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+package ocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nohsueh/ocache/consistenthash"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_Shutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	NewRelation("Drain", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("value of " + key), nil
+		},
+	))
+	p := NewHTTPPool("http://draining")
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// the pool of another peer, which has the draining one in its ring.
+	other := NewHTTPPool("http://other")
+	other.Set("http://other", srv.URL)
+	peer := other.httpGetters[srv.URL]
+
+	inflight := make(chan error)
+	go func() {
+		res := &pb.Response{}
+		err := peer.Get(&pb.Request{Relation: "Drain", Key: "slow"}, res)
+		if err == nil && string(res.Value) != "value of slow" {
+			err = errors.New("unexpected value " + string(res.Value))
+		}
+		inflight <- err
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- p.Shutdown(context.Background())
+	}()
+	for !p.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := peer.Get(&pb.Request{Relation: "Drain", Key: "new"}, &pb.Response{})
+	if !errors.Is(err, ErrPeerDraining) {
+		t.Fatalf("Get from a draining peer = %v; want ErrPeerDraining", err)
+	}
+	if _, ok := other.PickPeer("new"); ok {
+		t.Fatalf("draining peer is still in the ring")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the request in flight finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-inflight; err != nil {
+		t.Fatalf("request in flight failed: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ShutdownHandoff(t *testing.T) {
+	sender := httptest.NewServer(http.NotFoundHandler())
+	defer sender.Close()
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	defer receiver.Close()
+	keys := map[string][]byte{sender.URL: []byte("sender secret"), receiver.URL: []byte("receiver secret")}
+	pool := func(self string) *HTTPPool {
+		p := NewHTTPPool(self, WithRebalancing(0), WithAuth(HMACAuth{Secret: keys[self], ID: self, Keys: keys}))
+		p.Set(sender.URL, receiver.URL)
+		return p
+	}
+	ps, pr := pool(sender.URL), pool(receiver.URL)
+	sender.Config.Handler, receiver.Config.Handler = ps, pr
+
+	// both peers serve the relation in this process, the sender's is
+	// registered under another name so that the receiver's is found.
+	rs := NewRelation("Handoff", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, errors.New("the sender loads nothing")
+		},
+	))
+	rs.RegisterPeers(ps)
+	mu.Lock()
+	delete(relations, "Handoff")
+	relations["Handoff (sender)"] = rs
+	mu.Unlock()
+	rr := NewRelation("Handoff", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return nil, errors.New("handed off entries are not loaded")
+		},
+	))
+	rr.RegisterPeers(pr)
+	defer func() {
+		mu.Lock()
+		delete(relations, "Handoff (sender)")
+		mu.Unlock()
+	}()
+
+	ring := consistenthash.New(defaultReplicas, nil)
+	ring.Add(sender.URL, receiver.URL)
+	var owned []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if ring.Get(key) == sender.URL {
+			owned = append(owned, key)
+			rs.populateCache(key, ByteView{bytes: []byte("value of " + key)})
+		}
+	}
+	if len(owned) == 0 {
+		t.Fatalf("the sender owns none of the keys")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ps.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range owned {
+		view, ok := rr.cache.get(key)
+		if !ok || view.String() != "value of "+key {
+			t.Fatalf("%s cached on the new owner as %q, %v", key, view.String(), ok)
+		}
+	}
+	if s := ps.RebalanceStats(); s.Moved != int64(len(owned)) || s.Failed != 0 {
+		t.Fatalf("unexpected sender stats %+v", s)
+	}
+	if s := pr.RebalanceStats(); s.Received != int64(len(owned)) {
+		t.Fatalf("unexpected receiver stats %+v", s)
+	}
+}
+
+func Test_ShutdownTimeout(t *testing.T) {
+	p := NewHTTPPool("http://self")
+	if !p.enter() {
+		t.Fatalf("pool refused a request before Shutdown")
+	}
+	defer p.leave()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v; want context.DeadlineExceeded", err)
+	}
+	if p.enter() {
+		t.Fatalf("pool accepted a request while draining")
+	}
+}
+
+func Test_DrainedPeerRejoins(t *testing.T) {
+	defer func(ttl time.Duration) { drainedPeerTTL = ttl }(drainedPeerTTL)
+	drainedPeerTTL = 20 * time.Millisecond
+
+	p := NewHTTPPool("http://self")
+	p.Set("http://self", "http://restarting")
+	p.dropPeer("http://restarting")
+	if len(p.ring().Nodes) != 1 {
+		t.Fatalf("drained peer is still in the ring: %+v", p.ring())
+	}
+	time.Sleep(2 * drainedPeerTTL)
+	if ring := p.ring(); len(ring.Nodes) != 2 {
+		t.Fatalf("drained peer did not rejoin the ring: %+v", ring)
+	}
+
+	// Set readmits every peer right away.
+	p.dropPeer("http://restarting")
+	p.Set("http://self", "http://restarting")
+	if ring := p.ring(); len(ring.Nodes) != 2 {
+		t.Fatalf("Set did not readmit the peer: %+v", ring)
+	}
+}
@@ -1,39 +1,221 @@
 package singleflight
 
-import "sync"
+// The panic and runtime.Goexit handling of doCall, newPanicError and
+// PanicError are adapted from golang.org/x/sync/singleflight
+// (https://cs.opensource.google/go/x/sync), under this license:
+//
+// Copyright 2013 The Go Authors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//   - Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//   - Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//   - Neither the name of Google Inc. nor the names of its contributors may
+//     be used to endorse or promote products derived from this software
+//     without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrGoexit is returned to waiters when fn called runtime.Goexit.
+var ErrGoexit = errors.New("singleflight: runtime.Goexit was called")
+
+// A PanicError is a value recovered from a panic in fn, together with the
+// stack trace of the goroutine that panicked. Do re-panics with it in every
+// caller, DoChan delivers it as the Result's Err.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("singleflight: %v\n\n%s", p.Value, p.Stack)
+}
+
+// Unwrap returns the recovered value if it is an error.
+func (p *PanicError) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+func newPanicError(v interface{}) error {
+	stack := debug.Stack()
+	// The first line of the stack trace is of the form "goroutine N [status]:"
+	// but by the time the panic reaches Do the goroutine may no longer exist
+	// and its status will have changed. Trim out the misleading line.
+	if line := bytes.IndexByte(stack, '\n'); line >= 0 {
+		stack = stack[line+1:]
+	}
+	return &PanicError{Value: v, Stack: stack}
+}
 
 type call struct {
 	wg  sync.WaitGroup
 	val interface{}
 	err error
+	// number of callers that joined an in-flight call.
+	dups  int
+	chans []chan<- Result
+}
+
+// Result holds the results of Do, so they can be passed on a channel.
+type Result struct {
+	Val    interface{}
+	Err    error
+	Shared bool
 }
 
+// Relation represents a class of work and forms a namespace in which
+// units of work can be executed with duplicate suppression.
 type Relation struct {
 	mu    sync.Mutex // protects calls
 	calls map[string]*call
 }
 
-func (r *Relation) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+// Do executes and returns the results of fn, making sure that only one
+// execution is in-flight for a given key at a time. If a duplicate comes
+// in, the duplicate caller waits for the original to complete and receives
+// the same results. shared reports whether the result was given to
+// multiple callers.
+func (r *Relation) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
 	r.mu.Lock()
 	if r.calls == nil {
 		r.calls = make(map[string]*call)
 	}
 	if c, ok := r.calls[key]; ok {
+		c.dups++
 		r.mu.Unlock()
 		c.wg.Wait()
-		return c.val, c.err
+
+		if e, ok := c.err.(*PanicError); ok {
+			panic(e)
+		}
+		return c.val, c.err, true
 	}
 	c := new(call)
 	c.wg.Add(1)
 	r.calls[key] = c
 	r.mu.Unlock()
 
-	c.val, c.err = fn()
-	c.wg.Done()
+	r.doCall(c, key, fn)
+	return c.val, c.err, c.dups > 0
+}
 
+// DoChan is like Do but returns a channel that will receive the results
+// when they are ready. fn runs in its own goroutine, so a panic in it is
+// delivered as a *PanicError instead of crashing the caller.
+func (r *Relation) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
 	r.mu.Lock()
-	delete(r.calls, key)
+	if r.calls == nil {
+		r.calls = make(map[string]*call)
+	}
+	if c, ok := r.calls[key]; ok {
+		c.dups++
+		c.chans = append(c.chans, ch)
+		r.mu.Unlock()
+		return ch
+	}
+	c := &call{chans: []chan<- Result{ch}}
+	c.wg.Add(1)
+	r.calls[key] = c
 	r.mu.Unlock()
 
-	return c.val, c.err
+	go func() {
+		defer func() {
+			// a panic has already been turned into c.err for the
+			// waiters, don't let it take the process down.
+			if _, ok := c.err.(*PanicError); ok {
+				_ = recover()
+			}
+		}()
+		r.doCall(c, key, fn)
+	}()
+
+	return ch
+}
+
+// doCall handles the single call for a key.
+func (r *Relation) doCall(c *call, key string, fn func() (interface{}, error)) {
+	normalReturn := false
+	recovered := false
+
+	// use double-defer to distinguish panic from runtime.Goexit,
+	// more details see https://golang.org/cl/134395
+	defer func() {
+		// the given function invoked runtime.Goexit
+		if !normalReturn && !recovered {
+			c.err = ErrGoexit
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		c.wg.Done()
+		if r.calls[key] == c {
+			delete(r.calls, key)
+		}
+
+		for _, ch := range c.chans {
+			ch <- Result{c.val, c.err, c.dups > 0}
+		}
+
+		if e, ok := c.err.(*PanicError); ok {
+			panic(e)
+		}
+		// c.err == ErrGoexit: the goroutine is already exiting,
+		// waiters have been released above.
+	}()
+
+	func() {
+		defer func() {
+			if !normalReturn {
+				// Ideally, we would wait to take a stack trace until we've
+				// determined whether this is a panic or a runtime.Goexit.
+				// Unfortunately, the only way we can distinguish the two is
+				// to see whether the recover stopped the goroutine from
+				// terminating, and by the time we know that, the part of
+				// the stack trace relevant to the panic has been discarded.
+				if v := recover(); v != nil {
+					c.err = newPanicError(v)
+				}
+			}
+		}()
+
+		c.val, c.err = fn()
+		normalReturn = true
+	}()
+
+	if !normalReturn {
+		recovered = true
+	}
+}
+
+// Forget tells the Relation to forget about a key. Future calls to Do for
+// this key will call fn rather than waiting for an earlier call to complete.
+func (r *Relation) Forget(key string) {
+	r.mu.Lock()
+	delete(r.calls, key)
+	r.mu.Unlock()
 }
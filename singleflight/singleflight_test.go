@@ -0,0 +1,196 @@
+package singleflight
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Do(t *testing.T) {
+	var r Relation
+	v, err, shared := r.Do("key", func() (interface{}, error) {
+		return "bar", nil
+	})
+	if v.(string) != "bar" || err != nil || shared {
+		t.Fatalf("Do = %v, %v, %v", v, err, shared)
+	}
+
+	someErr := errors.New("some error")
+	if _, err, _ := r.Do("key", func() (interface{}, error) {
+		return nil, someErr
+	}); err != someErr {
+		t.Fatalf("Do error = %v; want someErr", err)
+	}
+}
+
+func Test_DoDupSuppress(t *testing.T) {
+	var r Relation
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "bar", nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	var nshared int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, shared := r.Do("key", fn)
+			if err != nil || v.(string) != "bar" {
+				t.Errorf("Do = %v, %v", v, err)
+			}
+			if shared {
+				atomic.AddInt32(&nshared, 1)
+			}
+		}()
+	}
+	waitDups(&r, "key", n-1)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 || nshared != n {
+		t.Fatalf("calls = %d, shared = %d; want 1, %d", calls, nshared, n)
+	}
+}
+
+func Test_DoChan(t *testing.T) {
+	var r Relation
+	release := make(chan struct{})
+	ch1 := r.DoChan("key", func() (interface{}, error) {
+		<-release
+		return "bar", nil
+	})
+	ch2 := r.DoChan("key", func() (interface{}, error) {
+		t.Error("duplicate fn called")
+		return nil, nil
+	})
+	close(release)
+
+	for _, ch := range []<-chan Result{ch1, ch2} {
+		res := <-ch
+		if res.Err != nil || res.Val.(string) != "bar" || !res.Shared {
+			t.Fatalf("DoChan = %+v", res)
+		}
+	}
+}
+
+func Test_Forget(t *testing.T) {
+	var r Relation
+	release := make(chan struct{})
+	first := r.DoChan("key", func() (interface{}, error) {
+		<-release
+		return 1, nil
+	})
+
+	r.Forget("key")
+	if v, _, _ := r.Do("key", func() (interface{}, error) {
+		return 2, nil
+	}); v.(int) != 2 {
+		t.Fatalf("Do after Forget = %v; want 2", v)
+	}
+
+	close(release)
+	if res := <-first; res.Val.(int) != 1 {
+		t.Fatalf("forgotten call = %v; want 1", res.Val)
+	}
+}
+
+func Test_PanicDo(t *testing.T) {
+	var r Relation
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		panic("boom")
+	}
+
+	const n = 5
+	var wg sync.WaitGroup
+	var panics int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if e, ok := recover().(*PanicError); ok && e.Value == "boom" {
+					atomic.AddInt32(&panics, 1)
+				}
+			}()
+			_, _, _ = r.Do("key", fn)
+		}()
+	}
+	waitDups(&r, "key", n-1)
+	close(release)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("waiters deadlocked after panic")
+	}
+	if panics != n {
+		t.Fatalf("%d callers saw the panic; want %d", panics, n)
+	}
+}
+
+func Test_PanicDoChan(t *testing.T) {
+	var r Relation
+	res := <-r.DoChan("key", func() (interface{}, error) {
+		panic("boom")
+	})
+	var e *PanicError
+	if !errors.As(res.Err, &e) || e.Value != "boom" {
+		t.Fatalf("DoChan error = %v; want PanicError", res.Err)
+	}
+}
+
+func Test_Goexit(t *testing.T) {
+	var r Relation
+	release := make(chan struct{})
+	go func() {
+		_, _, _ = r.Do("key", func() (interface{}, error) {
+			<-release
+			runtime.Goexit()
+			return nil, nil
+		})
+	}()
+	waitDups(&r, "key", 0)
+	ch := r.DoChan("key", func() (interface{}, error) {
+		return nil, nil
+	})
+	close(release)
+
+	select {
+	case res := <-ch:
+		if res.Err != ErrGoexit {
+			t.Fatalf("waiter error = %v; want ErrGoexit", res.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiter deadlocked after Goexit")
+	}
+}
+
+// waitDups waits until key is in flight with at least n duplicate callers.
+func waitDups(r *Relation, key string, n int) {
+	for {
+		r.mu.Lock()
+		c, ok := r.calls[key]
+		done := ok && c.dups >= n
+		r.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
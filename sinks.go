@@ -0,0 +1,309 @@
+package ocache
+
+// The Sink interface and its implementations are adapted from groupcache
+// (https://github.com/golang/groupcache), Copyright 2012 Google Inc.,
+// also licensed under the Apache License, Version 2.0.
+
+import (
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// A Sink receives data from a Get call.
+//
+// Implementations of SinkGetter must call exactly one of the Set methods
+// on success. e is the time the value expires, or the zero time to use
+// the relation's configured expiry.
+type Sink interface {
+	// SetString sets the value to s.
+	SetString(s string, e time.Time) error
+
+	// SetBytes sets the value to the contents of v.
+	// The caller retains ownership of v.
+	SetBytes(v []byte, e time.Time) error
+
+	// SetProto sets the value to the encoded version of m.
+	// The caller retains ownership of m.
+	SetProto(m proto.Message, e time.Time) error
+
+	// view returns a frozen view of the bytes for caching.
+	view() (ByteView, error)
+}
+
+// A SinkGetter loads data for a key straight into a Sink, letting it pick
+// the cheapest way to hand the value over. A Relation prefers it to Get
+// when its Getter implements both.
+type SinkGetter interface {
+	GetSink(key string, dest Sink) error
+}
+
+// A SinkGetterFunc implements Getter and SinkGetter with a function.
+type SinkGetterFunc func(key string, dest Sink) error
+
+// GetSink implements SinkGetter interface function.
+func (f SinkGetterFunc) GetSink(key string, dest Sink) error {
+	return f(key, dest)
+}
+
+// Get implements Getter by loading into an AllocatingByteSliceSink.
+func (f SinkGetterFunc) Get(key string) ([]byte, error) {
+	var b []byte
+	err := f(key, AllocatingByteSliceSink(&b))
+	return b, err
+}
+
+var (
+	_ Getter     = SinkGetterFunc(nil)
+	_ SinkGetter = SinkGetterFunc(nil)
+)
+
+func setSinkView(s Sink, v ByteView) error {
+	// viewSetter is a Sink that can also receive its value from
+	// a ByteView. This is a fast path to minimize copies when the
+	// item was already cached locally in memory (where it's
+	// cached as a ByteView)
+	type viewSetter interface {
+		setView(v ByteView) error
+	}
+	if vs, ok := s.(viewSetter); ok {
+		return vs.setView(v)
+	}
+	if v.bytes == nil {
+		return s.SetString(v.str, v.expire)
+	}
+	return s.SetBytes(v.bytes, v.expire)
+}
+
+// StringSink returns a Sink that populates the provided string pointer.
+func StringSink(sp *string) Sink {
+	return &stringSink{sp: sp}
+}
+
+type stringSink struct {
+	sp *string
+	v  ByteView
+}
+
+func (s *stringSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *stringSink) SetString(v string, e time.Time) error {
+	s.v = ByteView{str: v, expire: e}
+	*s.sp = v
+	return nil
+}
+
+func (s *stringSink) SetBytes(v []byte, e time.Time) error {
+	return s.SetString(string(v), e)
+}
+
+func (s *stringSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.v = ByteView{bytes: b, expire: e}
+	*s.sp = string(b)
+	return nil
+}
+
+// ByteViewSink returns a Sink that populates a ByteView.
+func ByteViewSink(dst *ByteView) Sink {
+	if dst == nil {
+		panic("nil dst")
+	}
+	return &byteViewSink{dst: dst}
+}
+
+type byteViewSink struct {
+	dst *ByteView
+}
+
+func (s *byteViewSink) setView(v ByteView) error {
+	*s.dst = v
+	return nil
+}
+
+func (s *byteViewSink) view() (ByteView, error) {
+	return *s.dst, nil
+}
+
+func (s *byteViewSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	*s.dst = ByteView{bytes: b, expire: e}
+	return nil
+}
+
+func (s *byteViewSink) SetBytes(b []byte, e time.Time) error {
+	*s.dst = ByteView{bytes: cloneBytes(b), expire: e}
+	return nil
+}
+
+func (s *byteViewSink) SetString(v string, e time.Time) error {
+	*s.dst = ByteView{str: v, expire: e}
+	return nil
+}
+
+// ProtoSink returns a sink that unmarshals binary proto values into m.
+func ProtoSink(m proto.Message) Sink {
+	return &protoSink{dst: m}
+}
+
+type protoSink struct {
+	dst proto.Message // authoritative value
+	v   ByteView      // encoded
+}
+
+func (s *protoSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *protoSink) SetBytes(b []byte, e time.Time) error {
+	err := proto.Unmarshal(b, s.dst)
+	if err != nil {
+		return err
+	}
+	s.v = ByteView{bytes: cloneBytes(b), expire: e}
+	return nil
+}
+
+func (s *protoSink) SetString(v string, e time.Time) error {
+	err := proto.Unmarshal([]byte(v), s.dst)
+	if err != nil {
+		return err
+	}
+	s.v = ByteView{str: v, expire: e}
+	return nil
+}
+
+func (s *protoSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// round trip through the encoding rather than assigning *m, which
+	// would share m's memory with the caller.
+	err = proto.Unmarshal(b, s.dst)
+	if err != nil {
+		return err
+	}
+	s.v = ByteView{bytes: b, expire: e}
+	return nil
+}
+
+// AllocatingByteSliceSink returns a Sink that allocates
+// a byte slice to hold the received value and assigns
+// it to *dst. The memory is not retained by ocache.
+func AllocatingByteSliceSink(dst *[]byte) Sink {
+	return &allocBytesSink{dst: dst}
+}
+
+type allocBytesSink struct {
+	dst *[]byte
+	v   ByteView
+}
+
+func (s *allocBytesSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *allocBytesSink) setView(v ByteView) error {
+	*s.dst = v.ByteSlice()
+	s.v = v
+	return nil
+}
+
+func (s *allocBytesSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setBytesOwned(b, e)
+}
+
+func (s *allocBytesSink) SetBytes(b []byte, e time.Time) error {
+	return s.setBytesOwned(cloneBytes(b), e)
+}
+
+func (s *allocBytesSink) setBytesOwned(b []byte, e time.Time) error {
+	if s.dst == nil {
+		return errors.New("nil AllocatingByteSliceSink *[]byte dst")
+	}
+	*s.dst = cloneBytes(b) // another copy, protecting the read-only s.v.bytes from the caller
+	s.v = ByteView{bytes: b, expire: e}
+	return nil
+}
+
+func (s *allocBytesSink) SetString(v string, e time.Time) error {
+	if s.dst == nil {
+		return errors.New("nil AllocatingByteSliceSink *[]byte dst")
+	}
+	*s.dst = []byte(v)
+	s.v = ByteView{str: v, expire: e}
+	return nil
+}
+
+// TruncatingByteSliceSink returns a Sink that writes up to len(*dst)
+// bytes to *dst. If more bytes are available, they're silently
+// truncated. If fewer bytes are available than len(*dst), *dst
+// is shrunk to fit the number of bytes available.
+func TruncatingByteSliceSink(dst *[]byte) Sink {
+	return &truncBytesSink{dst: dst}
+}
+
+type truncBytesSink struct {
+	dst *[]byte
+	v   ByteView
+}
+
+func (s *truncBytesSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *truncBytesSink) setView(v ByteView) error {
+	n := v.Copy(*s.dst)
+	*s.dst = (*s.dst)[:n]
+	s.v = v
+	return nil
+}
+
+func (s *truncBytesSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setBytesOwned(b, e)
+}
+
+func (s *truncBytesSink) SetBytes(b []byte, e time.Time) error {
+	return s.setBytesOwned(cloneBytes(b), e)
+}
+
+func (s *truncBytesSink) setBytesOwned(b []byte, e time.Time) error {
+	if s.dst == nil {
+		return errors.New("nil TruncatingByteSliceSink *[]byte dst")
+	}
+	n := copy(*s.dst, b)
+	if n < len(*s.dst) {
+		*s.dst = (*s.dst)[:n]
+	}
+	s.v = ByteView{bytes: b, expire: e}
+	return nil
+}
+
+func (s *truncBytesSink) SetString(v string, e time.Time) error {
+	if s.dst == nil {
+		return errors.New("nil TruncatingByteSliceSink *[]byte dst")
+	}
+	n := copy(*s.dst, v)
+	if n < len(*s.dst) {
+		*s.dst = (*s.dst)[:n]
+	}
+	s.v = ByteView{str: v, expire: e}
+	return nil
+}
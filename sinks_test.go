@@ -0,0 +1,51 @@
+package ocache
+
+import (
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"testing"
+	"time"
+)
+
+func Test_Sinks(t *testing.T) {
+	expire := time.Now().Add(time.Hour).Round(0)
+	r := NewRelation("Sinks", 1<<10, SinkGetterFunc(
+		func(key string, dest Sink) error {
+			if key == "proto" {
+				return dest.SetProto(&pb.Request{Relation: "Person", Key: "Tom"}, expire)
+			}
+			return dest.SetString("value of "+key, expire)
+		},
+	))
+
+	var view ByteView
+	if err := r.GetInto("key", ByteViewSink(&view)); err != nil || view.String() != "value of key" {
+		t.Fatalf("ByteViewSink = %q, %v", view, err)
+	}
+	if !view.Expire().Equal(expire) {
+		t.Fatalf("expiry set by the getter lost, got %v", view.Expire())
+	}
+
+	var s string
+	if err := r.GetInto("key", StringSink(&s)); err != nil || s != "value of key" {
+		t.Fatalf("StringSink = %q, %v", s, err)
+	}
+
+	var b []byte
+	if err := r.GetInto("key", AllocatingByteSliceSink(&b)); err != nil || string(b) != "value of key" {
+		t.Fatalf("AllocatingByteSliceSink = %q, %v", b, err)
+	}
+	b[0] = 'X'
+	if view, _ := r.Get("key"); view.String() != "value of key" {
+		t.Fatalf("caller mutated the cached value: %q", view)
+	}
+
+	b = make([]byte, 5)
+	if err := r.GetInto("key", TruncatingByteSliceSink(&b)); err != nil || string(b) != "value" {
+		t.Fatalf("TruncatingByteSliceSink = %q, %v", b, err)
+	}
+
+	req := &pb.Request{}
+	if err := r.GetInto("proto", ProtoSink(req)); err != nil || req.GetKey() != "Tom" {
+		t.Fatalf("ProtoSink = %v, %v", req, err)
+	}
+}
@@ -0,0 +1,265 @@
+package ocache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot is snapshotMagic, snapshotVersion, the relation name, the
+// number of entries and the entries from the least to the most recently
+// used, followed by the CRC-32C of everything before it. Strings and byte
+// slices are prefixed with their length as a uvarint. An entry is its key,
+// encoding, stale and expire deadlines as varint Unix nanoseconds (0 for
+// none) and value.
+const (
+	snapshotMagic   = "OCSNAP"
+	snapshotVersion = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrBadSnapshot is returned by LoadSnapshot for input that is not a
+// complete, intact snapshot.
+var ErrBadSnapshot = errors.New("ocache: bad snapshot")
+
+// WithSnapshot warms the relation's cache from the snapshot at path when
+// it is created, and saves a new snapshot there every interval. A missing
+// file is not an error. With an interval <= 0 the snapshot is only loaded.
+func WithSnapshot(path string, interval time.Duration) RelationOption {
+	return func(r *Relation) {
+		r.snapshotPath = path
+		r.snapshotInterval = interval
+	}
+}
+
+// SaveSnapshot writes the relation's cached entries, with their deadlines
+// and in LRU order, to w.
+func (r *Relation) SaveSnapshot(w io.Writer) error {
+	entries := r.cache.entries()
+
+	crc := crc32.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], x)])
+	}
+	putVarint := func(x int64) {
+		bw.Write(buf[:binary.PutVarint(buf[:], x)])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		bw.WriteString(s)
+	}
+
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	putString(r.name)
+	putUvarint(uint64(len(entries)))
+	for _, e := range entries {
+		putString(e.key)
+		putString(e.view.encoding)
+		putVarint(unixNano(e.view.stale))
+		putVarint(unixNano(e.view.expire))
+		putUvarint(uint64(e.view.Len()))
+		if _, err := e.view.WriteTo(bw); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// LoadSnapshot adds the entries saved by SaveSnapshot to the relation's
+// cache, keeping their LRU order. Nothing is added unless the whole
+// snapshot is intact. Entries that have expired since are skipped.
+func (r *Relation) LoadSnapshot(rd io.Reader) error {
+	sr := &snapshotReader{r: bufio.NewReader(rd), crc: crc32.New(crcTable)}
+
+	magic := make([]byte, len(snapshotMagic))
+	if err := sr.readFull(magic); err != nil || string(magic) != snapshotMagic {
+		return fmt.Errorf("%w: not a snapshot", ErrBadSnapshot)
+	}
+	version, err := sr.ReadByte()
+	if err != nil {
+		return sr.fail(err)
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, version)
+	}
+	name, err := sr.readString()
+	if err != nil {
+		return sr.fail(err)
+	}
+	if name != r.name {
+		return fmt.Errorf("%w: snapshot of relation %q", ErrBadSnapshot, name)
+	}
+	n, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return sr.fail(err)
+	}
+
+	var entries []cacheEntry
+	for i := uint64(0); i < n; i++ {
+		var e cacheEntry
+		if e.key, err = sr.readString(); err != nil {
+			return sr.fail(err)
+		}
+		if e.view.encoding, err = sr.readString(); err != nil {
+			return sr.fail(err)
+		}
+		stale, err := binary.ReadVarint(sr)
+		if err != nil {
+			return sr.fail(err)
+		}
+		expire, err := binary.ReadVarint(sr)
+		if err != nil {
+			return sr.fail(err)
+		}
+		e.view.stale, e.view.expire = fromUnixNano(stale), fromUnixNano(expire)
+		if e.view.bytes, err = sr.readBytes(); err != nil {
+			return sr.fail(err)
+		}
+		entries = append(entries, e)
+	}
+
+	sum := sr.crc.Sum32()
+	var want uint32
+	if err := binary.Read(sr.r, binary.BigEndian, &want); err != nil {
+		return sr.fail(err)
+	}
+	if sum != want {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if e.view.expired(now) {
+			continue
+		}
+		if _, ok := getCompressor(e.view.encoding); e.view.encoding != "" && !ok {
+			continue
+		}
+		r.populateCache(e.key, e.view)
+	}
+	return nil
+}
+
+// snapshotReader reads a snapshot while checksumming the bytes consumed.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (s *snapshotReader) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (s *snapshotReader) readFull(p []byte) error {
+	n, err := io.ReadFull(s.r, p)
+	s.crc.Write(p[:n])
+	return err
+}
+
+func (s *snapshotReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(s)
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: %d byte field", ErrBadSnapshot, n)
+	}
+	// grow with the bytes actually there rather than allocate the length
+	// read, which the checksum hasn't vouched for yet.
+	var b bytes.Buffer
+	if _, err := io.CopyN(io.MultiWriter(&b, s.crc), s.r, int64(n)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (s *snapshotReader) readString() (string, error) {
+	b, err := s.readBytes()
+	return string(b), err
+}
+
+// fail reports a read error, most likely a truncated snapshot.
+func (s *snapshotReader) fail(err error) error {
+	if errors.Is(err, ErrBadSnapshot) {
+		return err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated", ErrBadSnapshot)
+	}
+	return err
+}
+
+// startSnapshots loads the snapshot file and keeps saving it.
+func (r *Relation) startSnapshots() {
+	if f, err := os.Open(r.snapshotPath); err == nil {
+		err = r.LoadSnapshot(f)
+		_ = f.Close()
+		if err != nil {
+			log.Println("[Cache] Failed to load snapshot", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Println("[Cache] Failed to open snapshot", err)
+	}
+
+	if r.snapshotInterval <= 0 {
+		return
+	}
+	r.stopSnapshots = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(r.snapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.saveSnapshotFile(); err != nil {
+					log.Println("[Cache] Failed to save snapshot", err)
+				}
+			case <-r.stopSnapshots:
+				return
+			}
+		}
+	}()
+}
+
+// saveSnapshotFile replaces the snapshot file atomically, so a crash never
+// leaves a partial snapshot behind.
+func (r *Relation) saveSnapshotFile() error {
+	f, err := os.CreateTemp(filepath.Dir(r.snapshotPath), filepath.Base(r.snapshotPath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := r.SaveSnapshot(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), r.snapshotPath)
+}
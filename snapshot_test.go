@@ -0,0 +1,115 @@
+package ocache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func snapshotKeys(r *Relation) []string {
+	keys := make([]string, 0)
+	for _, e := range r.cache.entries() {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+func Test_Snapshot(t *testing.T) {
+	for _, opts := range [][]RelationOption{nil, {WithArena()}} {
+		getter := GetterFunc(func(key string) ([]byte, error) {
+			return []byte("value of " + key), nil
+		})
+		r := NewRelation("Snapshot", 1<<10, getter, append(opts, WithExpiry(time.Hour, 2*time.Hour))...)
+		for _, key := range []string{"k1", "k2", "k3", "k1"} {
+			if _, err := r.Get(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.populateCache("gone", ByteView{str: "x", expire: time.Now().Add(-time.Second)})
+		var buf bytes.Buffer
+		if err := r.SaveSnapshot(&buf); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := buf.Bytes()
+
+		warm := NewRelation("Snapshot", 1<<10, GetterFunc(func(key string) ([]byte, error) {
+			return nil, errors.New("warm relation must not load " + key)
+		}), opts...)
+		if err := warm.LoadSnapshot(bytes.NewReader(snapshot)); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"k2", "k3", "k1"}
+		if r.cache.useArena() {
+			// an arena evicts in insertion order.
+			want = []string{"k1", "k2", "k3"}
+		}
+		if got := snapshotKeys(warm); !reflect.DeepEqual(got, want) {
+			t.Fatalf("loaded %s, want %s", got, want)
+		}
+		view, err := warm.Get("k2")
+		if err != nil || view.String() != "value of k2" {
+			t.Fatalf("warm Get(k2) = %q, %v", view.String(), err)
+		}
+		if orig, _ := r.cache.get("k2"); !view.Expire().Equal(orig.Expire()) {
+			t.Fatalf("expire %v not kept, want %v", view.Expire(), orig.Expire())
+		}
+
+		cold := NewRelation("Snapshot", 1<<10, getter, opts...)
+		corrupt := append([]byte(nil), snapshot...)
+		corrupt[len(corrupt)/2] ^= 1
+		for _, bad := range [][]byte{corrupt, snapshot[:len(snapshot)-1], []byte("junk")} {
+			if err := cold.LoadSnapshot(bytes.NewReader(bad)); !errors.Is(err, ErrBadSnapshot) {
+				t.Fatalf("LoadSnapshot of a bad snapshot = %v", err)
+			}
+		}
+		if n := cold.CacheStats().Items; n != 0 {
+			t.Fatalf("a bad snapshot added %d entries", n)
+		}
+	}
+
+	// a truncated snapshot claiming a huge key doesn't allocate it.
+	huge := append([]byte(snapshotMagic), snapshotVersion, byte(len("Snapshot")))
+	huge = append(huge, "Snapshot"...)
+	huge = binary.AppendUvarint(append(huge, 1), math.MaxInt32)
+	huge = append(huge, "short"...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := NewRelation("Snapshot", 0, GetterFunc(func(key string) ([]byte, error) {
+		return nil, nil
+	})).LoadSnapshot(bytes.NewReader(huge)); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("LoadSnapshot of a truncated snapshot = %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("LoadSnapshot allocated %d bytes for a truncated snapshot", n)
+	}
+}
+
+func Test_SnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relation.snapshot")
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	})
+
+	r := NewRelation("SnapshotFile", 0, getter, WithSnapshot(path, 0))
+	if _, err := r.Get("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.saveSnapshotFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewRelation("SnapshotFile", 0, getter, WithSnapshot(path, 0))
+	if view, ok := restarted.cache.get("key"); !ok || view.String() != "key" {
+		t.Fatalf("restarted relation did not load the snapshot")
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %s", matches)
+	}
+}
@@ -0,0 +1,194 @@
+package ocache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"io"
+	"log"
+	"net/http"
+)
+
+// streamContentType is requested in the Accept header by peers that want
+// a value as a stream of length-delimited pb.Chunk messages.
+const streamContentType = "application/x-ocache-stream"
+
+// streamChunkSize is the most data a single pb.Chunk carries.
+const streamChunkSize = 64 << 10
+
+// ErrValueTooLarge is returned for values above a relation's
+// WithMaxValueSize limit.
+var ErrValueTooLarge = errors.New("ocache: value too large")
+
+// WithMaxValueSize refuses values larger than bytes, whether they are
+// loaded locally, fetched from a peer or streamed with GetReader.
+func WithMaxValueSize(bytes int64) RelationOption {
+	return func(r *Relation) {
+		r.maxValueSize = bytes
+	}
+}
+
+func (r *Relation) checkSize(size int64) error {
+	if r.maxValueSize > 0 && size > r.maxValueSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrValueTooLarge, size, r.maxValueSize)
+	}
+	return nil
+}
+
+// GetReader returns a reader for the value of a key. A value owned by a
+// remote peer that supports it is streamed rather than buffered in full;
+// like any value fetched from a peer it is not cached locally.
+func (r *Relation) GetReader(key string) (io.ReadCloser, error) {
+	if key == "" {
+		return nil, fmt.Errorf("key is required")
+	}
+
+	if r.peers != nil {
+		if peer, ok := r.peers.PickPeer(key); ok {
+			if sg, ok := peer.(StreamGetter); ok {
+				rc, err := r.getStreamFromPeer(sg, key)
+				if err == nil || errors.Is(err, ErrValueTooLarge) {
+					return rc, err
+				}
+				log.Println("[Cache] Failed to stream from peer", err)
+			}
+		}
+	}
+
+	view, err := r.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(view.Reader()), nil
+}
+
+func (r *Relation) getStreamFromPeer(peer StreamGetter, key string) (io.ReadCloser, error) {
+	rc, err := peer.GetStream(&pb.Request{
+		Relation: r.name,
+		Key:      key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sized, ok := rc.(interface{ Size() int64 }); ok {
+		if err := r.checkSize(sized.Size()); err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// writeStream writes view as length-delimited pb.Chunk messages.
+func writeStream(w http.ResponseWriter, view ByteView) error {
+	w.Header().Set("Content-Type", streamContentType)
+	bw := bufio.NewWriter(w)
+	for off := 0; off == 0 || off < view.Len(); off += streamChunkSize {
+		end := off + streamChunkSize
+		if end > view.Len() {
+			end = view.Len()
+		}
+		chunk := &pb.Chunk{Data: view.Slice(off, end).rawBytes()}
+		if off == 0 {
+			chunk.Size = int64(view.Len())
+		}
+		if _, err := protodelim.MarshalTo(bw, chunk); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// GetStream implements StreamGetter by asking for a chunked response.
+func (h *httpGetter) GetStream(in *pb.Request) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, keyURL(h.baseURL, in), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", streamContentType)
+	res, err := do(h.client, h.auth, req)
+	if err != nil {
+		return nil, err
+	}
+	if h.isDraining(res) {
+		_ = res.Body.Close()
+		return nil, ErrPeerDraining
+	}
+	if res.StatusCode != http.StatusOK {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("server returned: %v", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != streamContentType {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("server returned %q instead of a stream", ct)
+	}
+
+	cr := &chunkReader{body: res.Body, r: bufio.NewReader(res.Body)}
+	// read the first chunk now to learn the size of the value.
+	if err := cr.next(); err != nil {
+		_ = res.Body.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return cr, nil
+}
+
+var _ StreamGetter = (*httpGetter)(nil)
+
+// chunkReader reads a value streamed as pb.Chunk messages.
+type chunkReader struct {
+	body io.Closer
+	r    *bufio.Reader
+	size int64  // announced by the first chunk
+	read int64  // data received so far
+	buf  []byte // unread data of the current chunk
+	// whether the first chunk has been read
+	started bool
+}
+
+// Size returns the size of the whole value.
+func (c *chunkReader) Size() int64 {
+	return c.size
+}
+
+func (c *chunkReader) next() error {
+	chunk := &pb.Chunk{}
+	if err := protodelim.UnmarshalFrom(c.r, chunk); err != nil {
+		return err
+	}
+	if !c.started {
+		c.started = true
+		c.size = chunk.GetSize()
+	}
+	c.buf = chunk.GetData()
+	c.read += int64(len(c.buf))
+	if c.read > c.size {
+		return fmt.Errorf("stream longer than the announced %d bytes", c.size)
+	}
+	return nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.read == c.size {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error {
+	return c.body.Close()
+}
@@ -0,0 +1,151 @@
+package ocache
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// WithTLS secures the traffic between peers. The pool talks to peers over
+// HTTPS with client, which carries the pool's client certificate for
+// mutual TLS, and TLSConfig returns server for serving the pool. Peers
+// must then be Set with https URLs.
+func WithTLS(server, client *tls.Config) PoolOption {
+	return func(p *HTTPPool) {
+		p.serverTLS = server
+		p.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: client,
+			},
+		}
+	}
+}
+
+// WithPeerVerification only serves callers presenting a verified client
+// certificate for one of the peers passed to Set: a certificate with the
+// peer's URL as a URI SAN or, failing that, one valid for the host of a
+// single peer. Peers sharing a host, e.g. on different ports, need URI
+// SANs to be told apart. The peer's URL becomes the caller's identity for
+// WithReaders and WithAdmins. With an Authenticator too, requests that
+// it verifies as another identity are refused. It requires a server
+// tls.Config that asks for client certificates, e.g. with
+// tls.RequireAndVerifyClientCert.
+func WithPeerVerification() PoolOption {
+	return func(p *HTTPPool) {
+		p.verifyPeers = true
+	}
+}
+
+// TLSConfig returns the server tls.Config given to WithTLS, e.g. for an
+// http.Server serving the pool with ListenAndServeTLS("", "").
+func (p *HTTPPool) TLSConfig() *tls.Config {
+	return p.serverTLS
+}
+
+// peerIdentity returns the peer the client certificate of request names
+// in a URI SAN, or else the only peer whose host it is valid for.
+func (p *HTTPPool) peerIdentity(request *http.Request) (string, bool) {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := request.TLS.VerifiedChains[0][0]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, uri := range cert.URIs {
+		for _, peer := range p.members {
+			if uri.String() == peer {
+				return peer, true
+			}
+		}
+	}
+	var match []string
+	for _, peer := range p.members {
+		u, err := url.Parse(peer)
+		if err != nil {
+			continue
+		}
+		if cert.VerifyHostname(u.Hostname()) == nil {
+			match = append(match, peer)
+		}
+	}
+	if len(match) > 1 {
+		p.Log("Certificate of %s is valid for peers %v, it needs a URI SAN", request.RemoteAddr, match)
+		return "", false
+	}
+	if len(match) == 0 {
+		return "", false
+	}
+	return match[0], true
+}
+
+// A CertReloader serves a certificate and key from files, reloading them
+// when they change on disk, so certificates can be rotated without
+// restarting. Use GetCertificate and GetClientCertificate in a tls.Config.
+type CertReloader struct {
+	certFile, keyFile string
+	mu                sync.Mutex // guards cert and modTime
+	cert              *tls.Certificate
+	modTime           time.Time // of the newest of the files when loaded
+}
+
+// NewCertReloader loads the PEM encoded certificate and key in certFile
+// and keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the files if they changed since the last load.
+func (c *CertReloader) reload() error {
+	var modTime time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+func (c *CertReloader) current() (*tls.Certificate, error) {
+	if err := c.reload(); err != nil {
+		// a rotation in progress may leave the files mismatched for a
+		// moment, keep serving the last good certificate.
+		log.Println("[TLS] Failed to reload certificate", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current()
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current()
+}
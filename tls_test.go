@@ -0,0 +1,251 @@
+package ocache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ocache test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue returns PEM encoded certificate and key for a server and client
+// named by host, an IP address or a DNS name, and by the URIs if any.
+func (ca *testCA) issue(t *testing.T, serial int64, host string, uris ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) keyPair(t *testing.T, serial int64, host string, uris ...string) tls.Certificate {
+	cert, err := tls.X509KeyPair(ca.issue(t, serial, host, uris...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func Test_MutualTLS(t *testing.T) {
+	NewRelation("TLS", 0, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		},
+	))
+	ca := newTestCA(t)
+	serverCert := ca.keyPair(t, 2, "127.0.0.1")
+	p := NewHTTPPool("https://server", WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, nil), WithPeerVerification())
+	srv := httptest.NewUnstartedServer(p)
+	srv.TLS = p.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+	p.Set("https://server", srv.URL)
+
+	for _, tt := range []struct {
+		name  string
+		certs []tls.Certificate
+		want  string
+	}{
+		{"peer", []tls.Certificate{ca.keyPair(t, 3, "127.0.0.1")}, ""},
+		{"stranger", []tls.Certificate{ca.keyPair(t, 4, "stranger.example")}, "403"},
+		{"anonymous", nil, "certificate"},
+	} {
+		client := NewHTTPPool("https://client", WithTLS(nil, &tls.Config{
+			Certificates: tt.certs,
+			RootCAs:      ca.pool,
+		}))
+		client.Set(srv.URL)
+		peer := client.httpGetters[srv.URL]
+		res := &pb.Response{}
+		err := peer.Get(&pb.Request{Relation: "TLS", Key: "key"}, res)
+		switch {
+		case tt.want == "" && (err != nil || string(res.Value) != "key"):
+			t.Fatalf("%s: Get = %q, %v", tt.name, res.Value, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Fatalf("%s: Get = %v; want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func Test_PeerIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	p := NewHTTPPool("https://127.0.0.1:8001", WithPeerVerification())
+	p.Set("https://127.0.0.1:8001", "https://127.0.0.1:8002", "https://other.example")
+	for _, tt := range []struct {
+		cert tls.Certificate
+		want string
+	}{
+		{ca.keyPair(t, 2, "other.example"), "https://other.example"},
+		{ca.keyPair(t, 3, "127.0.0.1", "https://127.0.0.1:8002"), "https://127.0.0.1:8002"},
+		// valid for both peers on 127.0.0.1.
+		{ca.keyPair(t, 4, "127.0.0.1"), ""},
+		{ca.keyPair(t, 5, "stranger.example"), ""},
+	} {
+		leaf, err := x509.ParseCertificate(tt.cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/_ocache/r/k", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+		if id, ok := p.peerIdentity(req); id != tt.want || ok != (tt.want != "") {
+			t.Fatalf("peerIdentity = %q, %v; want %q", id, ok, tt.want)
+		}
+	}
+
+	// a signed request can't speak for another peer than its certificate.
+	cert := ca.keyPair(t, 6, "other.example")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{"https://other.example": []byte("other secret"), "admin": []byte("admin secret")}
+	p = NewHTTPPool("https://127.0.0.1:8001", WithPeerVerification(), WithAuth(HMACAuth{Keys: keys}))
+	p.Set("https://127.0.0.1:8001", "https://other.example")
+	for _, tt := range []struct {
+		id   string
+		want int
+	}{
+		{"https://other.example", http.StatusOK},
+		{"admin", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/_ocache/r/k", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+		if err := (HMACAuth{Secret: keys[tt.id], ID: tt.id}).Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		id, ok := p.authenticate(w, req)
+		if ok != (tt.want == http.StatusOK) || (ok && id != "https://other.example") || (!ok && w.Code != tt.want) {
+			t.Fatalf("signed as %s: authenticate = %q, %v (%d)", tt.id, id, ok, w.Code)
+		}
+	}
+}
+
+func Test_CertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(serial int64, modTime time.Time) {
+		certPEM, keyPEM := ca.issue(t, serial, "127.0.0.1")
+		for name, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := os.WriteFile(name, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(name, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	serial := func(c *CertReloader) int64 {
+		cert, err := c.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	now := time.Now()
+	write(10, now.Add(-time.Minute))
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := serial(c); s != 10 {
+		t.Fatalf("serving certificate %d, want 10", s)
+	}
+
+	write(11, now)
+	if s := serial(c); s != 11 {
+		t.Fatalf("serving certificate %d after rotation, want 11", s)
+	}
+
+	// a broken rotation keeps the last good certificate.
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, now.Add(time.Minute), now.Add(time.Minute))
+	if s := serial(c); s != 11 {
+		t.Fatalf("serving certificate %d after a broken rotation, want 11", s)
+	}
+}
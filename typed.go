@@ -0,0 +1,55 @@
+package ocache
+
+// A TypedGetter loads a typed value for a key.
+type TypedGetter[T any] interface {
+	Get(key string) (T, error)
+}
+
+// A TypedGetterFunc implements TypedGetter with a function.
+type TypedGetterFunc[T any] func(key string) (T, error)
+
+// Get implements TypedGetter interface function.
+func (f TypedGetterFunc[T]) Get(key string) (T, error) {
+	return f(key)
+}
+
+// A TypedRelation is a Relation whose values are of type T. Values are
+// encoded with a Codec when they are loaded, so the cache and the peer
+// protocol still deal in bytes, and decoded on every Get.
+type TypedRelation[T any] struct {
+	relation *Relation
+	codec    Codec[T]
+}
+
+// NewTypedRelation creates a TypedRelation backed by a new Relation called
+// name. Every peer must use the same codec for the relation.
+func NewTypedRelation[T any](name string, cacheBytes int64, getter TypedGetter[T], codec Codec[T], opts ...RelationOption) *TypedRelation[T] {
+	if getter == nil {
+		panic("nil TypedGetter")
+	}
+	r := NewRelation(name, cacheBytes, GetterFunc(
+		func(key string) ([]byte, error) {
+			v, err := getter.Get(key)
+			if err != nil {
+				return nil, err
+			}
+			return codec.Marshal(v)
+		},
+	), opts...)
+	return &TypedRelation[T]{relation: r, codec: codec}
+}
+
+// Get the value for a key.
+func (t *TypedRelation[T]) Get(key string) (T, error) {
+	view, err := t.relation.Get(key)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return t.codec.Unmarshal(view.rawBytes())
+}
+
+// Relation returns the untyped Relation, e.g. to register peers.
+func (t *TypedRelation[T]) Relation() *Relation {
+	return t.relation
+}
@@ -0,0 +1,58 @@
+package ocache
+
+import (
+	pb "github.com/nohsueh/ocache/ocachepb"
+	"reflect"
+	"testing"
+)
+
+type score struct {
+	Name  string
+	Score int
+}
+
+func Test_Codecs(t *testing.T) {
+	s := score{Name: "Tom", Score: 630}
+	for name, codec := range map[string]Codec[score]{
+		"json": JSONCodec[score]{},
+		"gob":  GobCodec[score]{},
+	} {
+		data, err := codec.Marshal(s)
+		if err != nil {
+			t.Fatalf("%s marshal: %v", name, err)
+		}
+		if got, err := codec.Unmarshal(data); err != nil || got != s {
+			t.Fatalf("%s round trip = %+v, %v", name, got, err)
+		}
+	}
+
+	req := &pb.Request{Relation: "Person", Key: "Tom"}
+	data, err := ProtoCodec[*pb.Request]{}.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := (ProtoCodec[*pb.Request]{}).Unmarshal(data); err != nil ||
+		got.GetRelation() != "Person" || got.GetKey() != "Tom" {
+		t.Fatalf("proto round trip = %v, %v", got, err)
+	}
+}
+
+func Test_TypedRelation(t *testing.T) {
+	loads := 0
+	r := NewTypedRelation[[]score]("Typed", 1<<10, TypedGetterFunc[[]score](
+		func(key string) ([]score, error) {
+			loads++
+			return []score{{Name: key, Score: len(key)}}, nil
+		},
+	), JSONCodec[[]score]{})
+
+	expect := []score{{Name: "Jack", Score: 4}}
+	for i := 0; i < 2; i++ {
+		if v, err := r.Get("Jack"); err != nil || !reflect.DeepEqual(v, expect) {
+			t.Fatalf("Get = %+v, %v", v, err)
+		}
+	}
+	if loads != 1 || r.Relation().CacheStats().Hits != 1 {
+		t.Fatalf("typed value not cached, %d loads", loads)
+	}
+}